@@ -1,65 +1,72 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"github.com/bdelliott/wfsync/pkg/credentials"
 	"github.com/bdelliott/wfsync/pkg/fatsecret"
-	"github.com/bdelliott/wfsync/pkg/oauth1"
+	"log"
+	"time"
 )
 
 // standalone client for FatSecret development/testing
 func main() {
 
-	provider := oauth1.Provider{
-		RequestTokenURL: "http://www.fatsecret.com/oauth/request_token",
-		CallbackURL: "oob",
-		AuthorizeURL: "http://www.fatsecret.com/oauth/authorize",
-		AccessTokenURL: "http://www.fatsecret.com/oauth/access_token",
-		RequestURL: "http://platform.fatsecret.com/rest/server.api",
-	}
-	credentials := oauth1.CredentialsFromEnv("fatsecret")
+	ctx := context.Background()
 
-	oauthClient := oauth1.Client{
-		Credentials: credentials,
-		Provider: provider,
+	creds, err := credentials.Env{}.Load(credentials.FatSecret)
+	if err != nil {
+		log.Fatal("Missing FatSecret credentials, set ", credentials.Env{}.Describe(credentials.FatSecret))
 	}
 
+	fsClient := fatsecret.NewClient(fatsecret.StateInit(creds.Key, creds.Secret, "oob"))
+	oauthClient := fsClient.OAuthClient
+
 	// 3-legged oauth to access a fatsecret profile: https://platform.fatsecret.com/api/Default.aspx?screen=rapitlsa
 	// <HTTP Method>&<Request URL>&<Normalized Parameters>
 
 	// 1. Get a request token:
-	requestToken, requestTokenSecret := oauthClient.GetRequestToken("oob")
-	fmt.Println(requestTokenSecret)
+	requestToken, requestTokenSecret, err := oauthClient.GetRequestToken(ctx, "oob")
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// 2. authorize the request token:
-	authorizeUrl := oauthClient.GetAuthorizeURL(requestToken)
+	authorizeUrl, err := oauthClient.GetAuthorizeURL(requestToken)
+	if err != nil {
+		log.Fatal(err)
+	}
 	fmt.Println("Now visit the following URL in a browser to get a verifier code: ", authorizeUrl)
 
-
 	fmt.Print("Enter verifier code from browser: ")
-	var verifier int
-	_, err := fmt.Scanln(&verifier)
+	var verifier string
+	_, err = fmt.Scanln(&verifier)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
 
 	fmt.Println("Verifier code is: ", verifier)
 
 	// 3. Get an access token:
-	oauthToken, oauthTokenSecret := oauthClient.GetAccessToken(requestToken, requestTokenSecret, verifier)
+	oauthToken, oauthTokenSecret, err := oauthClient.GetAccessToken(ctx, requestToken, requestTokenSecret, verifier)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	oauthClient.Token = oauthToken
 	oauthClient.Secret = oauthTokenSecret
 
-
 	fmt.Println("Authorization complete, now testing access to the API itself....")
 
-	fmt.Println("user token: ", oauthClient.Token)
-
 	// okay, now issue a test request to the API (finally)
-	fsClient := fatsecret.Client{
-		OAuthClient: oauthClient,
+	fsClient.OAuthClient = oauthClient
+
+	month, err := fsClient.WeightsGetMonth(ctx, time.Now())
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	resp := fsClient.WeightsGetMonth()
-	fmt.Println(resp)
+	for _, day := range month.Days {
+		fmt.Println(day.Date.Time().Format("2006-01-02"), day.WeightKg, "kg")
+	}
 }
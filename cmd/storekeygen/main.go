@@ -1,7 +1,9 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"github.com/bdelliott/wfsync/pkg/config"
 	"github.com/gorilla/securecookie"
 	"log"
 	"os"
@@ -9,25 +11,32 @@ import (
 )
 
 const KEY_LENGTH = 64 // recommended value from gorilla
-const KEY_FILE = "sessionKeyFile"
 
 
 // generate a key for use with a gorilla session store
 func main() {
 
-	keyDir := filepath.Join(os.Getenv("HOME"), ".config", "wfsync")
-	err := os.MkdirAll(keyDir, 0700)
+	// the key is written where the daemon's config expects it
+	configFlags := config.AddFlags(flag.CommandLine)
+	flag.Parse()
+
+	cfg, err := configFlags.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	keyFile := cfg.SessionKeyFile
+	err = os.MkdirAll(filepath.Dir(keyFile), 0700)
 	if err != nil {
 		panic(err)
 	}
 
-	keyFile := filepath.Join(keyDir, KEY_FILE)
 	f, err := os.Create(keyFile)
 
 	key := securecookie.GenerateRandomKey(KEY_LENGTH)
 
 	if err != nil {
-		log.Fatal("Failed to create key file ", KEY_FILE)
+		log.Fatal("Failed to create key file ", keyFile)
 	}
 
 	n, err := f.Write(key)
@@ -35,5 +44,5 @@ func main() {
 		log.Fatal("Failed to write key to file")
 	}
 
-	fmt.Printf("Wrote %d bytes to keyfile %s\n", n, KEY_FILE)
+	fmt.Printf("Wrote %d bytes to keyfile %s\n", n, keyFile)
 }
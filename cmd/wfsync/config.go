@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/bdelliott/wfsync/pkg/config"
+	"github.com/bdelliott/wfsync/pkg/credentials"
+	"github.com/bdelliott/wfsync/pkg/worker"
+)
+
+// validate the config: wfsync config check [flags]
+//
+// Takes the same flags as the daemon and reports every problem with the resulting settings, including missing
+// API credentials and key files, then prints the settings.  Exits non-zero if anything is wrong.
+func configCommand(args []string) {
+
+	if len(args) == 0 || args[0] != "check" {
+		log.Fatal("Usage: wfsync config check [flags]")
+	}
+
+	flags := flag.NewFlagSet("config check", flag.ExitOnError)
+	configFlags := config.AddFlags(flags)
+	flags.Parse(args[1:])
+
+	cfg, err := configFlags.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	problems := make([]string, 0)
+
+	err = checkConfig(cfg)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	_, err = credentials.LoadAll(credentialSources(cfg), credentials.Withings, credentials.FatSecret)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	_, err = os.Stat(cfg.SessionKeyFile)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("no session key, run storekeygen: %s", err))
+	}
+
+	fmt.Printf("listen_addr: %s\n", cfg.ListenAddr)
+	fmt.Printf("data_dir: %s\n", cfg.DataDir)
+	fmt.Printf("db_path: %s\n", cfg.DBPath)
+	fmt.Printf("session_key_file: %s\n", cfg.SessionKeyFile)
+	fmt.Printf("token_key_file: %s\n", cfg.TokenKeyFile)
+	fmt.Printf("asset_dir: %s\n", cfg.AssetDir)
+	fmt.Printf("default_sync_interval: %s\n", cfg.DefaultSyncInterval)
+	fmt.Printf("withings_auth_callback_url: %s\n", cfg.WithingsAuthCallbackURL)
+	fmt.Printf("withings_notify_url: %s\n", cfg.WithingsNotifyURL)
+	fmt.Printf("withings_notify_fake: %t\n", cfg.WithingsNotifyFake)
+	fmt.Printf("fatsecret_auth_callback_url: %s\n", cfg.FatSecretAuthCallbackURL)
+	fmt.Printf("credentials_file: %s\n", cfg.CredentialsFile)
+	fmt.Printf("secrets_dir: %s\n", cfg.SecretsDir)
+	fmt.Printf("credentials_command: %q\n", cfg.CredentialsCommand)
+
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, "Problem:", problem)
+		}
+		os.Exit(1)
+	}
+
+	fmt.Println("Config OK")
+}
+
+// checkConfig validates the settings, including those only the worker knows how to check
+func checkConfig(cfg *config.Config) error {
+
+	err := cfg.Validate()
+	if err != nil {
+		return err
+	}
+
+	if !worker.ValidSyncInterval(cfg.DefaultSyncInterval) {
+		return fmt.Errorf("default_sync_interval %s is not one of the intervals users can pick", cfg.DefaultSyncInterval)
+	}
+
+	return nil
+}
+
+// where the providers' API credentials are looked for, in order
+func credentialSources(cfg *config.Config) credentials.Chain {
+
+	sources := credentials.Chain{
+		credentials.Env{},
+		credentials.SecretDir{Dir: cfg.SecretsDir},
+		credentials.File{Path: cfg.CredentialsFile},
+	}
+
+	if len(cfg.CredentialsCommand) > 0 {
+		sources = append(sources, credentials.Command{Name: cfg.CredentialsCommand[0], Args: cfg.CredentialsCommand[1:]})
+	}
+
+	return sources
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bdelliott/wfsync/pkg/config"
+)
+
+func TestCheckConfig(t *testing.T) {
+
+	assets := t.TempDir()
+	err := os.Mkdir(filepath.Join(assets, "templates"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		interval time.Duration
+		problem  string
+	}{
+		{6 * time.Hour, ""},
+		{24 * time.Hour, ""},
+		{2 * time.Hour, "not one of the intervals users can pick"},
+		{0, "default_sync_interval must be positive"},
+	} {
+		cfg := config.Default()
+		cfg.AssetDir = assets
+		cfg.WithingsAuthCallbackURL = "https://example.com/withingsAuthCallback"
+		cfg.FatSecretAuthCallbackURL = "https://example.com/fatsecretAuthCallback"
+		cfg.DefaultSyncInterval = tc.interval
+
+		err := checkConfig(cfg)
+		if tc.problem == "" {
+			if err != nil {
+				t.Errorf("%s: %s", tc.interval, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.problem) {
+			t.Errorf("%s: got %v, want %q", tc.interval, err, tc.problem)
+		}
+	}
+}
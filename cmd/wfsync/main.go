@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/bdelliott/wfsync/pkg/config"
 	"github.com/bdelliott/wfsync/pkg/db"
 	"github.com/bdelliott/wfsync/pkg/state"
 	"github.com/bdelliott/wfsync/pkg/web"
@@ -16,31 +21,49 @@ func main() {
 
 	log.SetFlags(log.Lshortfile | log.Ldate | log.Ltime | log.Lshortfile)
 
-	var withingsAuthCallbackURL string
-	var fatSecretAuthCallbackURL string
-
-	flag.StringVar(&withingsAuthCallbackURL, "withings-auth-callback-url", "",
-		"Withings Callback URL after user authorizes the app")
-
-	flag.StringVar(&fatSecretAuthCallbackURL, "fatsecret-auth-callback-url", "",
-		"Withings Callback URL after user authorizes the app")
+	// subcommands:
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrateCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rotate-token-key" {
+		rotateTokenKeyCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		configCommand(os.Args[2:])
+		return
+	}
 
+	configFlags := config.AddFlags(flag.CommandLine)
 	flag.Parse()
 
-	if withingsAuthCallbackURL == "" {
-		log.Fatal("Missing required flag -withings-auth-callback-url")
+	cfg, err := configFlags.Load()
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	if fatSecretAuthCallbackURL == "" {
-		log.Fatal("Missing required flag -fatsecret-auth-callback-url")
+	err = checkConfig(cfg)
+	if err != nil {
+		log.Fatal("Bad config: ", err)
 	}
 
-	sqlDB := db.Init()
+	sqlDB, tokenKeys, err := db.Init(context.Background(), cfg.DBPath, cfg.TokenKeyFile)
+	if err != nil {
+		log.Fatal("Failed to initialize DB: ", err)
+	}
 	defer sqlDB.Close()
 
-	s := state.Init(sqlDB, withingsAuthCallbackURL, fatSecretAuthCallbackURL)
+	s, err := state.Init(sqlDB, tokenKeys, cfg, credentialSources(cfg))
+	if err != nil {
+		log.Fatal("Failed to initialize: ", err)
+	}
+
+	// stop syncing and serving on interrupt:
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	go worker.SyncWorker(s)
+	go worker.NewScheduler(s).Run(ctx)
 
-	web.Serve(s)
+	web.Serve(ctx, s)
 }
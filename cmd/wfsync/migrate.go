@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/bdelliott/wfsync/pkg/config"
+	"github.com/bdelliott/wfsync/pkg/db"
+)
+
+// bring the db schema up to date: wfsync migrate [-dry-run]
+func migrateCommand(args []string) {
+
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "Print the SQL of pending migrations without applying them")
+	configFlags := config.AddFlags(flags)
+	flags.Parse(args)
+
+	cfg, err := configFlags.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	if *dryRun {
+		// a dry run mustn't touch the db, not even create it
+		sqlDB, err := db.OpenReadOnly(cfg.DBPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer sqlDB.Close()
+
+		pending, err := db.PendingMigrations(ctx, sqlDB)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if len(pending) == 0 {
+			fmt.Println("-- no pending migrations")
+		}
+
+		for _, m := range pending {
+			fmt.Printf("-- migration %d: %s\n", m.Version, m.Description)
+			for _, statement := range m.Statements {
+				fmt.Printf("%s;\n\n", statement)
+			}
+		}
+		return
+	}
+
+	sqlDB, err := db.Open(cfg.DBPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer sqlDB.Close()
+
+	err = db.Migrate(ctx, sqlDB)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	version, err := db.SchemaVersion(ctx, sqlDB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Schema is at version %d\n", version)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/bdelliott/wfsync/pkg/config"
+	"github.com/bdelliott/wfsync/pkg/db"
+)
+
+// rotate the key saved tokens are encrypted with: wfsync rotate-token-key
+//
+// The new key is written to the token key file plus .new, every token row's data key is re-sealed with it in one
+// transaction, and then the new key replaces the key file.  If there's no key yet, one is created and plaintext
+// tokens are encrypted.  Run again after an interrupted rotation, it finishes that rotation.  Run it while wfsync
+// is stopped, so nothing saves a token with the old key in the meantime.
+func rotateTokenKeyCommand(args []string) {
+
+	flags := flag.NewFlagSet("rotate-token-key", flag.ExitOnError)
+	configFlags := config.AddFlags(flags)
+	flags.Parse(args)
+
+	cfg, err := configFlags.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if os.Getenv(db.TokenKeyEnv) != "" {
+		log.Fatalf("The token key is set by %s; unset it to rotate the key in the key file", db.TokenKeyEnv)
+	}
+
+	ctx := context.Background()
+
+	sqlDB, err := db.Open(cfg.DBPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer sqlDB.Close()
+
+	err = db.Migrate(ctx, sqlDB)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	newKey, err := db.TokenKeyFileRotate(ctx, sqlDB, cfg.TokenKeyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("Tokens are now encrypted with key %s\n", newKey.ID)
+}
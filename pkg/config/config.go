@@ -0,0 +1,354 @@
+// Package config holds the wfsync daemon's settings, loaded from a YAML file and overridden by environment
+// variables and then command line flags.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is every setting of the daemon.  Paths left empty are resolved relative to DataDir.
+type Config struct {
+	ListenAddr string `yaml:"listen_addr"` // address the web server listens on
+
+	DataDir        string `yaml:"data_dir"`         // holds the database and key files
+	DBPath         string `yaml:"db_path"`          // SQLite database, <data_dir>/wfsync.db by default
+	SessionKeyFile string `yaml:"session_key_file"` // written by storekeygen, <data_dir>/sessionKeyFile by default
+	TokenKeyFile   string `yaml:"token_key_file"`   // encrypts saved tokens, <data_dir>/tokenKeyFile by default
+
+	AssetDir string `yaml:"asset_dir"` // templates and static files
+
+	DefaultSyncInterval time.Duration `yaml:"default_sync_interval"` // for users who haven't picked one
+
+	WithingsAuthCallbackURL  string `yaml:"withings_auth_callback_url"`  // Withings sends users back here
+	WithingsNotifyURL        string `yaml:"withings_notify_url"`         // enables notifications if set
+	WithingsNotifyFake       bool   `yaml:"withings_notify_fake"`        // keep subscriptions locally
+	FatSecretAuthCallbackURL string `yaml:"fatsecret_auth_callback_url"` // FatSecret sends users back here
+
+	CredentialsFile    string   `yaml:"credentials_file"`    // JSON API credentials, <data_dir>/credentials.json by default
+	SecretsDir         string   `yaml:"secrets_dir"`         // Docker/Kubernetes style secret files
+	CredentialsCommand []string `yaml:"credentials_command"` // helper printing API credentials and its arguments, if set
+}
+
+// EnvFile names the environment variable pointing at the config file, unless -config is given
+const EnvFile = "WFSYNC_CONFIG"
+
+// Default returns the settings used when nothing overrides them
+func Default() *Config {
+	return &Config{
+		ListenAddr:          ":8080",
+		DataDir:             filepath.Join(os.Getenv("HOME"), ".config", "wfsync"),
+		AssetDir:            "assets",
+		DefaultSyncInterval: 6 * time.Hour,
+		SecretsDir:          "/run/secrets",
+	}
+}
+
+// DefaultPath is the config file read when none is named.  It's fine for it not to exist.
+func DefaultPath() string {
+	return filepath.Join(os.Getenv("HOME"), ".config", "wfsync", "wfsync.yaml")
+}
+
+// a setting that can be overridden by name, as WFSYNC_<NAME> in the environment or -<name> on the command
+// line
+type setting struct {
+	name  string
+	usage string
+	set   func(c *Config, value string) error
+	bool  bool
+}
+
+func stringSetting(name string, usage string, field func(c *Config) *string) setting {
+	return setting{
+		name:  name,
+		usage: usage,
+		set: func(c *Config, value string) error {
+			*field(c) = value
+			return nil
+		},
+	}
+}
+
+var settings = []setting{
+	stringSetting("listen_addr", "Address to listen on", func(c *Config) *string { return &c.ListenAddr }),
+	stringSetting("data_dir", "Directory of the database and key files", func(c *Config) *string { return &c.DataDir }),
+	stringSetting("db_path", "SQLite database file", func(c *Config) *string { return &c.DBPath }),
+	stringSetting("session_key_file", "Session key file", func(c *Config) *string { return &c.SessionKeyFile }),
+	stringSetting("token_key_file", "Token encryption key file", func(c *Config) *string { return &c.TokenKeyFile }),
+	stringSetting("asset_dir", "Directory of templates and static files", func(c *Config) *string { return &c.AssetDir }),
+	{
+		name:  "default_sync_interval",
+		usage: "Sync interval for users who haven't picked one, e.g. 6h",
+		set: func(c *Config, value string) error {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return err
+			}
+			c.DefaultSyncInterval = d
+			return nil
+		},
+	},
+	stringSetting("withings_auth_callback_url", "Withings Callback URL after user authorizes the app",
+		func(c *Config) *string { return &c.WithingsAuthCallbackURL }),
+	stringSetting("withings_notify_url",
+		"Withings notification callback URL (the /withingsNotify endpoint), enables near-real-time sync",
+		func(c *Config) *string { return &c.WithingsNotifyURL }),
+	{
+		name:  "withings_notify_fake",
+		usage: "Keep Withings notification subscriptions locally instead of calling the API (for development)",
+		set: func(c *Config, value string) error {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return err
+			}
+			c.WithingsNotifyFake = b
+			return nil
+		},
+		bool: true,
+	},
+	stringSetting("fatsecret_auth_callback_url", "FatSecret Callback URL after user authorizes the app",
+		func(c *Config) *string { return &c.FatSecretAuthCallbackURL }),
+	stringSetting("credentials_file", "JSON file with API credentials per provider",
+		func(c *Config) *string { return &c.CredentialsFile }),
+	stringSetting("secrets_dir", "Directory of secret files like withings_api_key and withings_api_secret",
+		func(c *Config) *string { return &c.SecretsDir }),
+	{
+		name: "credentials_command",
+		usage: `Command printing {"key": ..., "secret": ...} for the provider name given as its last argument, ` +
+			`either a program path or a JSON list of the program and its arguments`,
+		set: func(c *Config, value string) error {
+			command, err := parseCommand(value)
+			if err != nil {
+				return err
+			}
+			c.CredentialsCommand = command
+			return nil
+		},
+	},
+}
+
+// a command from the environment or command line: a JSON list like ["pass", "show"], or else the program
+// alone, spaces and all
+func parseCommand(value string) ([]string, error) {
+
+	if !strings.HasPrefix(strings.TrimSpace(value), "[") {
+		if value == "" {
+			return nil, nil
+		}
+		return []string{value}, nil
+	}
+
+	var command []string
+	err := json.Unmarshal([]byte(value), &command)
+	if err != nil {
+		return nil, fmt.Errorf("bad command list: %w", err)
+	}
+	return command, nil
+}
+
+func envName(s setting) string {
+	return "WFSYNC_" + strings.ToUpper(s.name)
+}
+
+func flagName(s setting) string {
+	return strings.Replace(s.name, "_", "-", -1)
+}
+
+// Flags are the command line flags overriding the config, see AddFlags
+type Flags struct {
+	fs     *flag.FlagSet
+	path   *string
+	values map[string]*flagValue
+}
+
+// a flag remembering its raw value, applied once the config file has been read
+type flagValue struct {
+	value  string
+	isBool bool
+}
+
+func (v *flagValue) String() string     { return v.value }
+func (v *flagValue) Set(s string) error { v.value = s; return nil }
+func (v *flagValue) IsBoolFlag() bool   { return v.isBool }
+
+// AddFlags defines -config and a flag for every setting on fs, e.g. -listen-addr for listen_addr.  Call Load
+// once fs is parsed.
+func AddFlags(fs *flag.FlagSet) *Flags {
+
+	f := &Flags{
+		fs:     fs,
+		path:   fs.String("config", "", fmt.Sprintf("Config file (default $%s or %s)", EnvFile, DefaultPath())),
+		values: make(map[string]*flagValue),
+	}
+
+	for _, s := range settings {
+		v := &flagValue{isBool: s.bool}
+		fs.Var(v, flagName(s), s.usage)
+		f.values[s.name] = v
+	}
+
+	return f
+}
+
+// Load reads the config file named by -config, $WFSYNC_CONFIG or else DefaultPath, then applies environment
+// variables and the flags given on the command line, in that order.  Paths left empty are resolved.
+func (f *Flags) Load() (*Config, error) {
+
+	path := *f.path
+	if path == "" {
+		path = os.Getenv(EnvFile)
+	}
+	optional := path == ""
+	if optional {
+		path = DefaultPath()
+	}
+
+	c, err := LoadFile(path, optional)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.applyEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	var flagErr error
+	f.fs.Visit(func(fl *flag.Flag) {
+		for _, s := range settings {
+			if flagName(s) == fl.Name && flagErr == nil {
+				err := s.set(c, f.values[s.name].value)
+				if err != nil {
+					flagErr = fmt.Errorf("bad -%s: %w", fl.Name, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	c.resolve()
+	return c, nil
+}
+
+// LoadFile reads a config file over the defaults.  A missing file is an error unless optional.  Unknown keys
+// are errors, to catch typos.
+func LoadFile(path string, optional bool) (*Config, error) {
+
+	c := Default()
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && optional {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	err = yaml.UnmarshalStrict(data, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+
+	return c, nil
+}
+
+func (c *Config) applyEnv() error {
+
+	for _, s := range settings {
+		value, ok := os.LookupEnv(envName(s))
+		if !ok {
+			continue
+		}
+
+		err := s.set(c, value)
+		if err != nil {
+			return fmt.Errorf("bad %s: %w", envName(s), err)
+		}
+	}
+
+	return nil
+}
+
+// fill in paths left empty from the data dir
+func (c *Config) resolve() {
+
+	if c.DBPath == "" {
+		c.DBPath = filepath.Join(c.DataDir, "wfsync.db")
+	}
+	if c.SessionKeyFile == "" {
+		c.SessionKeyFile = filepath.Join(c.DataDir, "sessionKeyFile")
+	}
+	if c.TokenKeyFile == "" {
+		c.TokenKeyFile = filepath.Join(c.DataDir, "tokenKeyFile")
+	}
+	if c.CredentialsFile == "" {
+		c.CredentialsFile = filepath.Join(c.DataDir, "credentials.json")
+	}
+}
+
+// Validate reports every problem with the settings the daemon needs
+func (c *Config) Validate() error {
+
+	problems := make([]string, 0)
+
+	if c.ListenAddr == "" {
+		problems = append(problems, "listen_addr is empty")
+	}
+
+	if c.DataDir == "" {
+		problems = append(problems, "data_dir is empty")
+	}
+
+	if c.DefaultSyncInterval <= 0 {
+		problems = append(problems, "default_sync_interval must be positive")
+	}
+
+	info, err := os.Stat(filepath.Join(c.AssetDir, "templates"))
+	if err != nil || !info.IsDir() {
+		problems = append(problems, fmt.Sprintf("asset_dir %q has no templates directory", c.AssetDir))
+	}
+
+	for _, u := range []struct {
+		name     string
+		value    string
+		required bool
+	}{
+		{"withings_auth_callback_url", c.WithingsAuthCallbackURL, true},
+		{"fatsecret_auth_callback_url", c.FatSecretAuthCallbackURL, true},
+		{"withings_notify_url", c.WithingsNotifyURL, false},
+	} {
+		if u.value == "" {
+			if u.required {
+				problems = append(problems, u.name+" is required")
+			}
+			continue
+		}
+
+		parsed, err := url.Parse(u.value)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			problems = append(problems, fmt.Sprintf("%s %q is not an http(s) URL", u.name, u.value))
+		}
+	}
+
+	if len(c.CredentialsCommand) > 0 && c.CredentialsCommand[0] == "" {
+		problems = append(problems, "credentials_command has no program")
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
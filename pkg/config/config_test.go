@@ -0,0 +1,225 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// write a config file into a temp dir
+func writeConfig(t *testing.T, yaml string) string {
+	path := filepath.Join(t.TempDir(), "wfsync.yaml")
+	err := ioutil.WriteFile(path, []byte(yaml), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// load the config as the daemon would with the given command line
+func load(t *testing.T, args ...string) (*Config, error) {
+	fs := flag.NewFlagSet("wfsync", flag.ContinueOnError)
+	flags := AddFlags(fs)
+	err := fs.Parse(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return flags.Load()
+}
+
+func TestLoadPrecedence(t *testing.T) {
+
+	path := writeConfig(t, `
+listen_addr: ":1"
+data_dir: /yaml
+asset_dir: /yaml/assets
+default_sync_interval: 12h
+`)
+	t.Setenv("WFSYNC_LISTEN_ADDR", ":2")
+	t.Setenv("WFSYNC_DATA_DIR", "/env")
+	t.Setenv("WFSYNC_WITHINGS_NOTIFY_FAKE", "true")
+
+	c, err := load(t, "-config", path, "-listen-addr", ":3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"listen_addr from flag over env and yaml", c.ListenAddr, ":3"},
+		{"data_dir from env over yaml", c.DataDir, "/env"},
+		{"asset_dir from yaml", c.AssetDir, "/yaml/assets"},
+		{"default_sync_interval from yaml", c.DefaultSyncInterval, 12 * time.Hour},
+		{"withings_notify_fake from env", c.WithingsNotifyFake, true},
+		{"secrets_dir default", c.SecretsDir, "/run/secrets"},
+		{"db_path resolved from data_dir", c.DBPath, filepath.Join("/env", "wfsync.db")},
+		{"token_key_file resolved from data_dir", c.TokenKeyFile, filepath.Join("/env", "tokenKeyFile")},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, tc.got, tc.want)
+		}
+	}
+}
+
+func TestLoadConfigPath(t *testing.T) {
+
+	path := writeConfig(t, "listen_addr: \":1\"\n")
+	t.Setenv(EnvFile, path)
+
+	c, err := load(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ListenAddr != ":1" {
+		t.Errorf("listen_addr from $%s: got %q", EnvFile, c.ListenAddr)
+	}
+
+	_, err = load(t, "-config", filepath.Join(t.TempDir(), "missing.yaml"))
+	if err == nil {
+		t.Error("missing -config file loaded")
+	}
+
+	t.Setenv(EnvFile, "")
+	t.Setenv("HOME", t.TempDir())
+	c, err = load(t)
+	if err != nil {
+		t.Fatalf("missing default config file: %s", err)
+	}
+	if c.ListenAddr != ":8080" {
+		t.Errorf("listen_addr default: got %q", c.ListenAddr)
+	}
+}
+
+func TestLoadBadValues(t *testing.T) {
+
+	path := writeConfig(t, "")
+
+	t.Setenv("WFSYNC_DEFAULT_SYNC_INTERVAL", "often")
+	_, err := load(t, "-config", path)
+	if err == nil || !strings.Contains(err.Error(), "WFSYNC_DEFAULT_SYNC_INTERVAL") {
+		t.Errorf("bad env value: got %v", err)
+	}
+
+	t.Setenv("WFSYNC_DEFAULT_SYNC_INTERVAL", "6h")
+	_, err = load(t, "-config", path, "-withings-notify-fake=maybe")
+	if err == nil || !strings.Contains(err.Error(), "-withings-notify-fake") {
+		t.Errorf("bad flag value: got %v", err)
+	}
+}
+
+func TestLoadCredentialsCommand(t *testing.T) {
+
+	path := writeConfig(t, `credentials_command: ["/opt/my helper", "--vault", "my vault"]`)
+	c, err := load(t, "-config", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c.CredentialsCommand, []string{"/opt/my helper", "--vault", "my vault"}) {
+		t.Errorf("from yaml: got %q", c.CredentialsCommand)
+	}
+
+	for _, tc := range []struct {
+		value string
+		want  []string
+	}{
+		{"/opt/my helper", []string{"/opt/my helper"}},
+		{`["pass", "show", "wfsync api"]`, []string{"pass", "show", "wfsync api"}},
+		{"", nil},
+	} {
+		c, err := load(t, "-config", path, "-credentials-command", tc.value)
+		if err != nil {
+			t.Errorf("%q: %s", tc.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(c.CredentialsCommand, tc.want) {
+			t.Errorf("%q: got %q, want %q", tc.value, c.CredentialsCommand, tc.want)
+		}
+	}
+
+	_, err = load(t, "-config", path, "-credentials-command", `["pass", `)
+	if err == nil {
+		t.Error("bad command list loaded")
+	}
+}
+
+func TestLoadFileUnknownKey(t *testing.T) {
+
+	path := writeConfig(t, "listen_adr: \":1\"\n")
+
+	_, err := LoadFile(path, false)
+	if err == nil || !strings.Contains(err.Error(), "listen_adr") {
+		t.Errorf("unknown key: got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+
+	assets := t.TempDir()
+	err := os.Mkdir(filepath.Join(assets, "templates"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := func() *Config {
+		c := Default()
+		c.DataDir = "/data"
+		c.AssetDir = assets
+		c.WithingsAuthCallbackURL = "https://example.com/withingsAuthCallback"
+		c.FatSecretAuthCallbackURL = "https://example.com/fatsecretAuthCallback"
+		return c
+	}
+
+	for _, tc := range []struct {
+		name     string
+		change   func(c *Config)
+		problems []string
+	}{
+		{"valid", func(c *Config) {}, nil},
+		{"notify url", func(c *Config) { c.WithingsNotifyURL = "http://example.com/withingsNotify" }, nil},
+		{"empty listen addr", func(c *Config) { c.ListenAddr = "" }, []string{"listen_addr is empty"}},
+		{"empty data dir", func(c *Config) { c.DataDir = "" }, []string{"data_dir is empty"}},
+		{"zero interval", func(c *Config) { c.DefaultSyncInterval = 0 },
+			[]string{"default_sync_interval must be positive"}},
+		{"no templates", func(c *Config) { c.AssetDir = t.TempDir() }, []string{"has no templates directory"}},
+		{"missing callbacks", func(c *Config) {
+			c.WithingsAuthCallbackURL = ""
+			c.FatSecretAuthCallbackURL = ""
+		}, []string{"withings_auth_callback_url is required", "fatsecret_auth_callback_url is required"}},
+		{"empty credentials command", func(c *Config) { c.CredentialsCommand = []string{"", "show"} },
+			[]string{"credentials_command has no program"}},
+		{"bad urls", func(c *Config) {
+			c.WithingsAuthCallbackURL = "example.com/callback"
+			c.WithingsNotifyURL = "ftp://example.com/notify"
+		}, []string{"withings_auth_callback_url \"example.com/callback\" is not an http(s) URL",
+			"withings_notify_url \"ftp://example.com/notify\" is not an http(s) URL"}},
+	} {
+		c := valid()
+		tc.change(c)
+
+		err := c.Validate()
+		if len(tc.problems) == 0 {
+			if err != nil {
+				t.Errorf("%s: %s", tc.name, err)
+			}
+			continue
+		}
+
+		if err == nil {
+			t.Errorf("%s: no error", tc.name)
+			continue
+		}
+		for _, problem := range tc.problems {
+			if !strings.Contains(err.Error(), problem) {
+				t.Errorf("%s: %q doesn't report %q", tc.name, err, problem)
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Package credentials loads the apps' API keys for the providers wfsync talks to, from the environment,
+// files or a helper command.
+package credentials
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Providers wfsync needs credentials for
+const (
+	Withings  = "withings"
+	FatSecret = "fatsecret"
+)
+
+// ErrNotFound is returned when a source has no credentials for a provider
+var ErrNotFound = errors.New("credentials not found")
+
+// Credentials are the app's key and secret for a provider: Withings' client id and secret, FatSecret's
+// consumer key and secret
+type Credentials struct {
+	Key    string
+	Secret string
+}
+
+// Source looks up credentials.  Load returns ErrNotFound when the source has nothing for the provider, and
+// any other error when it has something but it's unusable, e.g. a key without a secret.
+type Source interface {
+	Load(provider string) (Credentials, error)
+
+	// Describe says where the source looks for the provider's credentials, for error messages
+	Describe(provider string) string
+}
+
+// Chain tries each source in turn, the first to have the provider's credentials wins
+type Chain []Source
+
+func (c Chain) Load(provider string) (Credentials, error) {
+
+	for _, source := range c {
+		creds, err := source.Load(provider)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return Credentials{}, fmt.Errorf("%s: %w", source.Describe(provider), err)
+		}
+		return creds, nil
+	}
+
+	return Credentials{}, ErrNotFound
+}
+
+func (c Chain) Describe(provider string) string {
+
+	descriptions := make([]string, 0, len(c))
+	for _, source := range c {
+		descriptions = append(descriptions, source.Describe(provider))
+	}
+	return strings.Join(descriptions, ", or ")
+}
+
+// LoadAll loads every provider's credentials, reporting all the missing or broken ones at once
+func LoadAll(source Source, providers ...string) (map[string]Credentials, error) {
+
+	all := make(map[string]Credentials)
+	problems := make([]string, 0)
+
+	for _, provider := range providers {
+		creds, err := source.Load(provider)
+		if err == ErrNotFound {
+			problems = append(problems, fmt.Sprintf("no %s credentials, set %s", provider, source.Describe(provider)))
+			continue
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("bad %s credentials: %s", provider, err))
+			continue
+		}
+		all[provider] = creds
+	}
+
+	if len(problems) > 0 {
+		return nil, errors.New(strings.Join(problems, "; "))
+	}
+	return all, nil
+}
@@ -0,0 +1,86 @@
+package credentials
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// a source with fixed results per provider, not found for the rest
+type fakeSource struct {
+	name   string
+	creds  map[string]Credentials
+	errors map[string]error
+}
+
+func (f fakeSource) Load(provider string) (Credentials, error) {
+	err, ok := f.errors[provider]
+	if ok {
+		return Credentials{}, err
+	}
+	creds, ok := f.creds[provider]
+	if !ok {
+		return Credentials{}, ErrNotFound
+	}
+	return creds, nil
+}
+
+func (f fakeSource) Describe(provider string) string {
+	return f.name + " " + provider
+}
+
+func TestChain(t *testing.T) {
+
+	chain := Chain{
+		fakeSource{name: "first", creds: map[string]Credentials{Withings: {Key: "k1", Secret: "s1"}}},
+		fakeSource{
+			name:   "second",
+			creds:  map[string]Credentials{Withings: {Key: "k2", Secret: "s2"}, FatSecret: {Key: "k3", Secret: "s3"}},
+			errors: map[string]error{"broken": errors.New("unreadable")},
+		},
+	}
+
+	checkLoad(t, "first wins", chain, Withings, Credentials{Key: "k1", Secret: "s1"}, "")
+	checkLoad(t, "falls through", chain, FatSecret, Credentials{Key: "k3", Secret: "s3"}, "")
+	checkLoad(t, "error names its source", chain, "broken", Credentials{}, "second broken: unreadable")
+	checkLoad(t, "nowhere", chain, "other", Credentials{}, ErrNotFound.Error())
+
+	got := chain.Describe(Withings)
+	if got != "first withings, or second withings" {
+		t.Errorf("Describe: got %q", got)
+	}
+}
+
+func TestLoadAll(t *testing.T) {
+
+	source := fakeSource{
+		name:   "source",
+		creds:  map[string]Credentials{Withings: {Key: "wkey", Secret: "wsecret"}},
+		errors: map[string]error{"broken": errors.New("unreadable")},
+	}
+
+	all, err := LoadAll(source, Withings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all[Withings] != (Credentials{Key: "wkey", Secret: "wsecret"}) {
+		t.Errorf("got %+v", all)
+	}
+
+	// every problem is reported, not just the first
+	all, err = LoadAll(source, Withings, FatSecret, "broken")
+	if err == nil {
+		t.Fatalf("no error, got %+v", all)
+	}
+	for _, problem := range []string{"no fatsecret credentials, set source fatsecret", "bad broken credentials: unreadable"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("%q doesn't report %q", err, problem)
+		}
+	}
+	if strings.Contains(err.Error(), Withings) {
+		t.Errorf("%q reports withings", err)
+	}
+	if all != nil {
+		t.Errorf("got %+v with an error", all)
+	}
+}
@@ -0,0 +1,199 @@
+package credentials
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// EnvNames are the names of the environment variables holding a provider's credentials
+type EnvNames struct {
+	Key    string
+	Secret string
+}
+
+// DefaultEnvNames keeps the variable names wfsync has always used.  Providers not listed use
+// <PROVIDER>_API_KEY and <PROVIDER>_API_SECRET.
+var DefaultEnvNames = map[string]EnvNames{
+	Withings:  {Key: "WITHINGS_API_KEY", Secret: "WITHINGS_API_SECRET"},
+	FatSecret: {Key: "FATSECRET_API_CONSUMER_KEY", Secret: "FATSECRET_API_CONSUMER_SECRET"},
+}
+
+// Env reads credentials from environment variables, named by Names or DefaultEnvNames
+type Env struct {
+	Names map[string]EnvNames
+}
+
+func (e Env) names(provider string) EnvNames {
+
+	names, ok := e.Names[provider]
+	if !ok {
+		names, ok = DefaultEnvNames[provider]
+	}
+	if !ok {
+		prefix := strings.ToUpper(provider)
+		names = EnvNames{Key: prefix + "_API_KEY", Secret: prefix + "_API_SECRET"}
+	}
+	return names
+}
+
+func (e Env) Load(provider string) (Credentials, error) {
+	names := e.names(provider)
+	return pair(os.Getenv(names.Key), os.Getenv(names.Secret), names.Key, names.Secret)
+}
+
+func (e Env) Describe(provider string) string {
+	names := e.names(provider)
+	return fmt.Sprintf("environment variables %s and %s", names.Key, names.Secret)
+}
+
+// File reads credentials from a JSON file mapping provider names to their key and secret:
+//
+//	{"withings": {"key": "...", "secret": "..."}, "fatsecret": {"key": "...", "secret": "..."}}
+//
+// A missing file has no credentials.
+type File struct {
+	Path string
+}
+
+type fileEntry struct {
+	Key    string `json:"key"`
+	Secret string `json:"secret"`
+}
+
+func (f File) Load(provider string) (Credentials, error) {
+
+	data, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return Credentials{}, ErrNotFound
+	}
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	var entries map[string]fileEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("failed to parse: %w", err)
+	}
+
+	entry, ok := entries[provider]
+	if !ok {
+		return Credentials{}, ErrNotFound
+	}
+	return pair(entry.Key, entry.Secret, "key", "secret")
+}
+
+func (f File) Describe(provider string) string {
+	return fmt.Sprintf("%q in %s", provider, f.Path)
+}
+
+// SecretDir reads credentials from one file per value, as Docker and Kubernetes mount secrets: for example
+// /run/secrets/withings_api_key and /run/secrets/withings_api_secret.  Surrounding whitespace is ignored.
+type SecretDir struct {
+	Dir string
+}
+
+func (d SecretDir) paths(provider string) (string, string) {
+	prefix := filepath.Join(d.Dir, strings.ToLower(provider))
+	return prefix + "_api_key", prefix + "_api_secret"
+}
+
+func (d SecretDir) Load(provider string) (Credentials, error) {
+
+	keyPath, secretPath := d.paths(provider)
+
+	key, err := readSecretFile(keyPath)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	secret, err := readSecretFile(secretPath)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	return pair(key, secret, keyPath, secretPath)
+}
+
+func (d SecretDir) Describe(provider string) string {
+	keyPath, secretPath := d.paths(provider)
+	return fmt.Sprintf("files %s and %s", keyPath, secretPath)
+}
+
+// contents of a secret file, empty if it doesn't exist
+func readSecretFile(path string) (string, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// commandTimeout limits how long a Command may take
+const commandTimeout = 30 * time.Second
+
+// Command runs a helper, e.g. a password manager's CLI, with the provider name as its last argument.  It
+// must print {"key": "...", "secret": "..."}, or nothing if it has no credentials for the provider.
+type Command struct {
+	Name string
+	Args []string
+}
+
+func (c Command) Load(provider string) (Credentials, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	args := append(append([]string{}, c.Args...), provider)
+	cmd := exec.CommandContext(ctx, c.Name, args...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return Credentials{}, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	if len(bytes.TrimSpace(out)) == 0 {
+		return Credentials{}, ErrNotFound
+	}
+
+	var entry fileEntry
+	err = json.Unmarshal(out, &entry)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("failed to parse output: %w", err)
+	}
+	return pair(entry.Key, entry.Secret, "key", "secret")
+}
+
+func (c Command) Describe(provider string) string {
+	return fmt.Sprintf("the output of %s", strings.Join(append(append([]string{c.Name}, c.Args...), provider), " "))
+}
+
+// credentials from a key and secret found together: neither means there are none, only one is an error
+func pair(key string, secret string, keyName string, secretName string) (Credentials, error) {
+
+	if key == "" && secret == "" {
+		return Credentials{}, ErrNotFound
+	}
+	if key == "" {
+		return Credentials{}, fmt.Errorf("%s is set but %s is not", secretName, keyName)
+	}
+	if secret == "" {
+		return Credentials{}, fmt.Errorf("%s is set but %s is not", keyName, secretName)
+	}
+
+	return Credentials{Key: key, Secret: secret}, nil
+}
@@ -0,0 +1,131 @@
+package credentials
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// check a source's result for a provider: the credentials, or an error containing problem
+func checkLoad(t *testing.T, name string, source Source, provider string, want Credentials, problem string) {
+	t.Helper()
+
+	got, err := source.Load(provider)
+	switch {
+	case problem == "" && err != nil:
+		t.Errorf("%s: %s", name, err)
+	case problem == ErrNotFound.Error() && err != ErrNotFound:
+		t.Errorf("%s: got %v, want ErrNotFound", name, err)
+	case problem != "" && (err == nil || !strings.Contains(err.Error(), problem)):
+		t.Errorf("%s: got %v, want an error about %q", name, err, problem)
+	case got != want:
+		t.Errorf("%s: got %+v, want %+v", name, got, want)
+	}
+}
+
+func writeFile(t *testing.T, path string, data string, perm os.FileMode) {
+	t.Helper()
+
+	err := ioutil.WriteFile(path, []byte(data), perm)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnv(t *testing.T) {
+
+	t.Setenv("WITHINGS_API_KEY", "wkey")
+	t.Setenv("WITHINGS_API_SECRET", "wsecret")
+	t.Setenv("FATSECRET_API_CONSUMER_KEY", "fkey")
+	t.Setenv("FATSECRET_API_CONSUMER_SECRET", "")
+	t.Setenv("OTHER_API_KEY", "okey")
+	t.Setenv("OTHER_API_SECRET", "osecret")
+	t.Setenv("MY_KEY", "mkey")
+	t.Setenv("MY_SECRET", "msecret")
+
+	env := Env{}
+	checkLoad(t, "default names", env, Withings, Credentials{Key: "wkey", Secret: "wsecret"}, "")
+	checkLoad(t, "key without secret", env, FatSecret, Credentials{},
+		"FATSECRET_API_CONSUMER_KEY is set but FATSECRET_API_CONSUMER_SECRET is not")
+	checkLoad(t, "provider without default names", env, "other", Credentials{Key: "okey", Secret: "osecret"}, "")
+	checkLoad(t, "nothing set", env, "none", Credentials{}, ErrNotFound.Error())
+
+	named := Env{Names: map[string]EnvNames{Withings: {Key: "MY_KEY", Secret: "MY_SECRET"}}}
+	checkLoad(t, "configured names", named, Withings, Credentials{Key: "mkey", Secret: "msecret"}, "")
+
+	got := env.Describe(FatSecret)
+	if got != "environment variables FATSECRET_API_CONSUMER_KEY and FATSECRET_API_CONSUMER_SECRET" {
+		t.Errorf("Describe: got %q", got)
+	}
+}
+
+func TestSecretDir(t *testing.T) {
+
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "withings_api_key"), "wkey\n", 0600)
+	writeFile(t, filepath.Join(dir, "withings_api_secret"), "  wsecret\n", 0600)
+	writeFile(t, filepath.Join(dir, "fatsecret_api_secret"), "fsecret", 0600)
+
+	source := SecretDir{Dir: dir}
+	checkLoad(t, "both files", source, Withings, Credentials{Key: "wkey", Secret: "wsecret"}, "")
+	checkLoad(t, "secret file only", source, FatSecret, Credentials{}, "fatsecret_api_secret is set but")
+	checkLoad(t, "no files", source, "other", Credentials{}, ErrNotFound.Error())
+	checkLoad(t, "no dir", SecretDir{Dir: filepath.Join(dir, "missing")}, Withings, Credentials{},
+		ErrNotFound.Error())
+
+	err := os.Mkdir(filepath.Join(dir, "broken_api_key"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLoad(t, "unreadable file", source, "broken", Credentials{}, "broken_api_key")
+}
+
+func TestFile(t *testing.T) {
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "credentials.json")
+	writeFile(t, path, `{"withings": {"key": "wkey", "secret": "wsecret"}, "fatsecret": {"key": "fkey"}}`, 0600)
+
+	source := File{Path: path}
+	checkLoad(t, "listed", source, Withings, Credentials{Key: "wkey", Secret: "wsecret"}, "")
+	checkLoad(t, "key without secret", source, FatSecret, Credentials{}, "key is set but secret is not")
+	checkLoad(t, "not listed", source, "other", Credentials{}, ErrNotFound.Error())
+	checkLoad(t, "no file", File{Path: filepath.Join(dir, "missing.json")}, Withings, Credentials{},
+		ErrNotFound.Error())
+
+	bad := filepath.Join(dir, "bad.json")
+	writeFile(t, bad, `{"withings": `, 0600)
+	checkLoad(t, "bad json", File{Path: bad}, Withings, Credentials{}, "failed to parse")
+}
+
+func TestCommand(t *testing.T) {
+
+	// a path and an argument with spaces must reach the helper intact
+	dir := filepath.Join(t.TempDir(), "my helpers")
+	err := os.Mkdir(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	helper := filepath.Join(dir, "credentials helper")
+	writeFile(t, helper, `#!/bin/sh
+[ "$1" = "my vault" ] || { echo "bad vault $1" >&2; exit 2; }
+case "$2" in
+withings) echo '{"key": "wkey", "secret": "wsecret"}' ;;
+fatsecret) echo '{"key": "fkey"}' ;;
+broken) echo 'not json' ;;
+failing) echo 'helper failed' >&2; exit 1 ;;
+esac
+`, 0700)
+
+	source := Command{Name: helper, Args: []string{"my vault"}}
+	checkLoad(t, "printed", source, Withings, Credentials{Key: "wkey", Secret: "wsecret"}, "")
+	checkLoad(t, "key without secret", source, FatSecret, Credentials{}, "key is set but secret is not")
+	checkLoad(t, "nothing printed", source, "other", Credentials{}, ErrNotFound.Error())
+	checkLoad(t, "bad output", source, "broken", Credentials{}, "failed to parse output")
+	checkLoad(t, "failed", source, "failing", Credentials{}, "helper failed")
+	checkLoad(t, "wrong argument", Command{Name: helper, Args: []string{"my", "vault"}}, Withings, Credentials{},
+		"bad vault my")
+	checkLoad(t, "no helper", Command{Name: filepath.Join(dir, "missing")}, Withings, Credentials{}, "missing")
+}
@@ -1,25 +1,39 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"math"
+	"net/url"
 	"os"
 	"path/filepath"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3" // init sql driver
+	"github.com/mattn/go-sqlite3"
 	"golang.org/x/oauth2"
 )
 
+// ErrNotFound is returned when a looked up record doesn't exist
+var ErrNotFound = errors.New("not found")
+
+// ErrExists is returned when creating a record that would duplicate an existing one
+var ErrExists = errors.New("already exists")
+
 // User DB model
 type User struct {
-	UserID   string
-	UserName string
+	UserID       string
+	UserName     string
+	PasswordHash string // bcrypt hash, empty for accounts that can't log in with a password
 }
 
-// Weight DB model
+// Weight DB model.  The weight in kg is Value * 10^Unit, exactly as measured.
 type Weight struct {
-	Weight    float64
+	Value     int64
+	Unit      int
 	Timestamp int64 // epoch time (secs since 1970)
 }
 
@@ -29,215 +43,405 @@ type WithingsToken struct {
 	Token  oauth2.Token
 }
 
-// Init a SQLite db
-func Init() *sql.DB {
+// Init opens the SQLite db at dbPath, brings its schema up to date and loads the keys tokens are encrypted
+// with from tokenKeyPath.  On first start there's no key file yet: one is created, and any tokens saved in
+// plaintext by older versions are encrypted with it.
+func Init(ctx context.Context, dbPath string, tokenKeyPath string) (*sql.DB, *TokenKeys, error) {
 
-	dbDir := ensureDBDir()
-	dbPath := filepath.Join(dbDir, "wfsync.db")
-	db, err := sql.Open("sqlite3", dbPath)
+	db, err := Open(dbPath)
 	if err != nil {
-		log.Fatal("Failed to open DB: ", err)
+		return nil, nil, err
 	}
 
-	// create user table:
-	_, err = db.Exec(
-		`CREATE TABLE IF NOT EXISTS users 
-					(userId TEXT NOT NULL PRIMARY KEY,
-					 userName TEXT NOT NULL)`)
+	err = Migrate(ctx, db)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
 
+	keys, err := LoadTokenKeys(tokenKeyPath)
+	if err == ErrNoTokenKey {
+		var key *TokenKey
+		key, err = TokenKeyFileRotate(ctx, db, tokenKeyPath)
+		if err == nil {
+			log.Printf("Created token key %s in %s", key.ID, tokenKeyPath)
+			keys, err = LoadTokenKeys(tokenKeyPath)
+		}
+	}
 	if err != nil {
-		log.Fatal(err)
+		db.Close()
+		return nil, nil, fmt.Errorf("failed to load token key: %w", err)
 	}
 
-	// create withings token table:
-	_, err = db.Exec(
-		// token is a json-encoded oauth2.Token
-		`CREATE TABLE IF NOT EXISTS withingsTokens
-					(id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-					 userId TEXT NOT NULL,
-					 token TEXT NOT NULL, 
-					 FOREIGN KEY(userId) REFERENCES users(userId))`)
+	return db, keys, nil
+}
+
+// Open opens the SQLite db at dbPath without touching its schema, creating its directory if needed
+func Open(dbPath string) (*sql.DB, error) {
 
+	err := os.MkdirAll(filepath.Dir(dbPath), 0700)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("failed to create DB dir: %w", err)
 	}
 
-	// create weight measurements table:
-	_, err = db.Exec(
-		`CREATE TABLE IF NOT EXISTS weights
-					(id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-					 userId TEXT NOT NULL,
-					 weight FLOAT NOT NULL,
-					 timestamp INTEGER NOT NULL,
-					 FOREIGN KEY(userId) REFERENCES users(userId))`)
-
+	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("failed to open DB: %w", err)
 	}
 
-	// create fatsecret token table:
-	_, err = db.Exec(
-		// token and secret are oauth1 string values
-		`CREATE TABLE IF NOT EXISTS fatsecretTokens
-					(id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-					 userId TEXT NOT NULL,
-					 token TEXT NOT NULL,
-					 secret TEXT NOT NULL, 
-					 FOREIGN KEY(userId) REFERENCES users(userId))`)
+	return db, nil
+}
+
+// OpenReadOnly opens the existing SQLite db at dbPath read only, failing if there's no db there
+func OpenReadOnly(dbPath string) (*sql.DB, error) {
 
+	_, err := os.Stat(dbPath)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("failed to open DB: %w", err)
 	}
-	return db
-}
 
-func ensureDBDir() string {
-	dbDir := filepath.Join(os.Getenv("HOME"), ".config", "wfsync")
-	err := os.MkdirAll(dbDir, 0700)
+	// a URI filename, so the path's special characters are escaped
+	uri := "file:" + (&url.URL{Path: dbPath}).EscapedPath() + "?mode=ro"
+	db, err := sql.Open("sqlite3", uri)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to open DB: %w", err)
 	}
-	return dbDir
+
+	return db, nil
 }
 
 // UserGet looks up a user by user id
-func UserGet(db *sql.DB, userID string) (User, bool) {
-	rows, err := db.Query("SELECT * FROM users where userId=?", userID)
+func UserGet(ctx context.Context, db *sql.DB, userID string) (User, error) {
+	user := User{}
+
+	err := db.QueryRowContext(ctx,
+		"SELECT userId, userName, COALESCE(passwordHash, '') FROM users where userId=?", userID).
+		Scan(&user.UserID, &user.UserName, &user.PasswordHash)
+	if err == sql.ErrNoRows {
+		return user, ErrNotFound
+	}
 	if err != nil {
-		log.Fatal("Failed to query for user: ", err)
+		return user, fmt.Errorf("failed to query for user: %w", err)
 	}
-	defer rows.Close()
 
-	exists := rows.Next()
+	return user, nil
+}
 
+// UserGetByName looks up a user who can log in with a password by their user name
+func UserGetByName(ctx context.Context, db *sql.DB, userName string) (User, error) {
 	user := User{}
 
-	if exists {
-		err = rows.Scan(&user.UserID, &user.UserName)
-		if err != nil {
-			log.Fatal("Failed to read row: ", err)
-		}
+	err := db.QueryRowContext(ctx,
+		"SELECT userId, userName, passwordHash FROM users where userName=? AND passwordHash IS NOT NULL",
+		userName).Scan(&user.UserID, &user.UserName, &user.PasswordHash)
+	if err == sql.ErrNoRows {
+		return user, ErrNotFound
+	}
+	if err != nil {
+		return user, fmt.Errorf("failed to query for user: %w", err)
 	}
 
-	return user, exists
+	return user, nil
 }
 
-// UserSave saves a user by id
-func UserSave(db *sql.DB, userID string, userName string) {
+// UserCreate saves a new user, failing with ErrExists if their user name is taken
+func UserCreate(ctx context.Context, db *sql.DB, user User) error {
 
-	_, exists := UserGet(db, userID)
+	log.Printf("Saving user %s", user.UserID)
+	_, err := db.ExecContext(ctx, "INSERT INTO users (userId, userName, passwordHash) VALUES (?, ?, ?)",
+		user.UserID, user.UserName, user.PasswordHash)
 
-	if exists {
-		log.Printf("User %s already exists.", userID)
-		return
+	// the unique index on userName decides between concurrent sign ups for the same name
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return ErrExists
 	}
+	if err != nil {
+		return fmt.Errorf("failed to insert user: %w", err)
+	}
+	return nil
+}
+
+// tables holding a user's data, deleted along with the user.  users itself goes last since the others
+// reference it.
+var userTables = []string{
+	"measurements",
+	"fatsecretPushes",
+	"fatsecretDayPushes",
+	"withingsSyncCursors",
+	"fatsecretSyncCursors",
+	"withingsTokens",
+	"fatsecretTokens",
+	"oauthRequestTokens",
+	"userSettings",
+	"users",
+}
 
-	log.Printf("Saving user %s", userID)
-	_, err := db.Exec("INSERT INTO users (userid, username) VALUES (?, ?)", userID, userName)
+// UserDelete deletes the user and everything saved for them
+func UserDelete(ctx context.Context, db *sql.DB, userID string) error {
+
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		log.Fatal("Failed to insert user: ", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	defer tx.Rollback()
+
+	log.Print("Deleting user: ", userID)
+	for _, table := range userTables {
+		_, err = tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE userId=?", userID)
+		if err != nil {
+			return fmt.Errorf("failed to delete user rows from %s: %w", table, err)
+		}
+	}
+
+	return tx.Commit()
 }
 
-// WeightExists checks if a weight value is already saved
-func WeightExists(db *sql.DB, userID string, weight Weight) (exists bool) {
-	rows, err := db.Query("SELECT * FROM weights where userId=? AND weight=? AND timestamp=?",
-		userID, weight.Weight, weight.Timestamp)
+// UserSettingGet looks up a named per-user setting, if one was previously saved
+func UserSettingGet(ctx context.Context, db *sql.DB, userID string, name string) (string, error) {
+	var value string
+
+	err := db.QueryRowContext(ctx, "SELECT value FROM userSettings WHERE userId=? AND name=?", userID, name).
+		Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
 	if err != nil {
-		log.Fatal("Failed to query for weight: ", err)
+		return "", fmt.Errorf("failed to query for user setting: %w", err)
 	}
-	defer rows.Close()
 
-	exists = rows.Next()
-	return exists
+	return value, nil
 }
 
-// WeightSave saves a single weight measurement
-func WeightSave(db *sql.DB, userID string, weight Weight) {
-	exists := WeightExists(db, userID, weight)
+// UserSettingSave saves a named per-user setting, replacing any previous value
+func UserSettingSave(ctx context.Context, db *sql.DB, userID string, name string, value string) error {
+	_, err := db.ExecContext(ctx, "INSERT OR REPLACE INTO userSettings (userId, name, value) VALUES (?, ?, ?)",
+		userID, name, value)
 
-	if !exists {
-		_, err := db.Exec("INSERT INTO weights (userId, weight, timestamp) VALUES (?, ?, ?)",
-			userID, weight.Weight, weight.Timestamp)
+	if err != nil {
+		return fmt.Errorf("failed to save user setting: %w", err)
+	}
+	return nil
+}
+
+// UserSettingsGetAll retrieves all of the user's saved settings by name
+func UserSettingsGetAll(ctx context.Context, db *sql.DB, userID string) (map[string]string, error) {
 
+	rows, err := db.QueryContext(ctx, "SELECT name, value FROM userSettings WHERE userId=?", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for user settings: %w", err)
+	}
+	defer rows.Close()
+
+	settings := make(map[string]string)
+
+	for rows.Next() {
+		var name, value string
+		err = rows.Scan(&name, &value)
 		if err != nil {
-			log.Fatal("Failed to insert weight: ", err)
+			return nil, fmt.Errorf("failed to scan row: %w", err)
 		}
+		settings[name] = value
+	}
+
+	return settings, rows.Err()
+}
 
+// Kg returns the weight in kilograms
+func (w Weight) Kg() float64 {
+	return float64(w.Value) * math.Pow10(w.Unit)
+}
+
+// WeightsRecent returns the user's most recent weights, newest first
+func WeightsRecent(ctx context.Context, db *sql.DB, userID string, limit int) ([]Weight, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT value, unit, timestamp FROM weights WHERE userId=?
+		 ORDER BY timestamp DESC LIMIT ?`, userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for recent weights: %w", err)
 	}
+	defer rows.Close()
+
+	return scanWeights(rows)
 }
 
-// WeightsSync saves a number of weight measurements for the user
-func WeightsSync(db *sql.DB, userID string, weights []Weight) {
-	for _, weight := range weights {
-		WeightSave(db, userID, weight)
+// WeightsUnpushed returns the user's saved weights that have not been pushed to FatSecret yet, oldest first
+func WeightsUnpushed(ctx context.Context, db *sql.DB, userID string) ([]Weight, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT value, unit, timestamp FROM weights w WHERE userId=? AND NOT EXISTS
+			(SELECT 1 FROM fatsecretPushes p WHERE p.userId=w.userId AND p.timestamp=w.timestamp)
+		 ORDER BY timestamp`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for unpushed weights: %w", err)
 	}
+	defer rows.Close()
+
+	return scanWeights(rows)
 }
 
-// WithingsTokenGet retrieves a withings token, if one was previously saved
-func WithingsTokenGet(db *sql.DB, user User) (*oauth2.Token, bool) {
+func scanWeights(rows *sql.Rows) ([]Weight, error) {
+	weights := make([]Weight, 0)
 
-	rows, err := db.Query("SELECT token FROM withingsTokens where userId=?", user.UserID)
+	for rows.Next() {
+		var weight Weight
+		err := rows.Scan(&weight.Value, &weight.Unit, &weight.Timestamp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		weights = append(weights, weight)
+	}
+
+	return weights, rows.Err()
+}
+
+// WeightPushedSave records that a weight was pushed to FatSecret so it is never posted twice
+func WeightPushedSave(ctx context.Context, db *sql.DB, userID string, weight Weight) error {
+	// weights measured at the same time share a push
+	_, err := db.ExecContext(ctx, "INSERT OR IGNORE INTO fatsecretPushes (userId, timestamp) VALUES (?, ?)",
+		userID, weight.Timestamp)
 
 	if err != nil {
-		log.Fatal("An error occurred fetching a token: ", err)
+		return fmt.Errorf("failed to insert weight push: %w", err)
 	}
+	return nil
+}
 
+// WeightsPushedGet returns the timestamps of the user's weights pushed to FatSecret, oldest first
+func WeightsPushedGet(ctx context.Context, db *sql.DB, userID string) ([]int64, error) {
+	rows, err := db.QueryContext(ctx, "SELECT timestamp FROM fatsecretPushes WHERE userId=? ORDER BY timestamp",
+		userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for weight pushes: %w", err)
+	}
 	defer rows.Close()
 
-	token := oauth2.Token{}
-	exists := rows.Next()
+	timestamps := make([]int64, 0)
 
-	if exists {
-		var buf string
-		err = rows.Scan(&buf)
-		if err != nil {
-			log.Fatal("Failed to scan row: ", err)
-		}
-		err = json.Unmarshal([]byte(buf), &token)
+	for rows.Next() {
+		var timestamp int64
+		err = rows.Scan(&timestamp)
 		if err != nil {
-			log.Fatal("Failed to unmarshal token: ", err)
+			return nil, fmt.Errorf("failed to scan row: %w", err)
 		}
+		timestamps = append(timestamps, timestamp)
 	}
 
-	return &token, exists
+	return timestamps, rows.Err()
 }
 
-// WithingsTokenSave save the withings token in the user record
-func WithingsTokenSave(db *sql.DB, user User, token *oauth2.Token) {
+// WithingsTokenGet retrieves a withings token, if one was previously saved.  keys decrypt it, and may be nil
+// if no token key is set up.
+func WithingsTokenGet(ctx context.Context, db *sql.DB, keys *TokenKeys, user User) (*oauth2.Token, error) {
+
+	var buf string
+	var dataKey sql.NullString
+	err := db.QueryRowContext(ctx, "SELECT token, dataKey FROM withingsTokens where userId=?", user.UserID).
+		Scan(&buf, &dataKey)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for withings token: %w", err)
+	}
+
+	values, err := decryptTokens(keys, dataKey, columnAAD("withingsTokens", "dataKey", user.UserID),
+		tokenColumn{buf, columnAAD("withingsTokens", "token", user.UserID)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt withings token for user %s: %w", user.UserID, err)
+	}
+
+	token := oauth2.Token{}
+	err = json.Unmarshal([]byte(values[0]), &token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal withings token for user %s: %w", user.UserID, err)
+	}
+
+	return &token, nil
+}
+
+// WithingsTokenExists reports whether the user has linked Withings, without decrypting their token
+func WithingsTokenExists(ctx context.Context, db *sql.DB, user User) (bool, error) {
+	var n int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM withingsTokens WHERE userId=?", user.UserID).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("failed to query for withings token: %w", err)
+	}
+	return n > 0, nil
+}
+
+// WithingsTokenSave save the withings token in the user record, encrypted with keys unless they're nil
+func WithingsTokenSave(ctx context.Context, db *sql.DB, keys *TokenKeys, user User, token *oauth2.Token) error {
 
 	buf, err := json.Marshal(token)
 	if err != nil {
-		log.Fatal("Failed to marshal token: ", err)
+		return fmt.Errorf("failed to marshal token: %w", err)
+	}
+	dataKey, values, err := encryptTokens(keys, columnAAD("withingsTokens", "dataKey", user.UserID),
+		tokenColumn{string(buf), columnAAD("withingsTokens", "token", user.UserID)})
+	if err != nil {
+		return fmt.Errorf("failed to encrypt token: %w", err)
+	}
+	tokenStr := values[0]
+
+	exists, err := WithingsTokenExists(ctx, db, user)
+	if err != nil {
+		return err
 	}
-	tokenStr := string(buf)
 
-	_, exists := WithingsTokenGet(db, user)
 	if exists {
 		// replace the existing token
 		log.Print("Updating withings token for user: ", user.UserID)
-		_, err := db.Exec("UPDATE withingsTokens SET token=? WHERE userId=?", tokenStr, user.UserID)
+		_, err = db.ExecContext(ctx, "UPDATE withingsTokens SET token=?, dataKey=? WHERE userId=?", tokenStr,
+			dataKey, user.UserID)
 
 		if err != nil {
-			log.Fatal("Failed to update token value: ", err)
+			return fmt.Errorf("failed to update token value: %w", err)
 		}
 	} else {
 		// insert a new token record
 		log.Print("Saving new withings token for user: ", user.UserID)
-		_, err = db.Exec("INSERT INTO withingsTokens (userId, token) VALUES (?, ?)", user.UserID, tokenStr)
+		_, err = db.ExecContext(ctx, "INSERT INTO withingsTokens (userId, token, dataKey) VALUES (?, ?, ?)",
+			user.UserID, tokenStr, dataKey)
 
 		if err != nil {
-			log.Fatal("Failed to insert token: ", err)
+			return fmt.Errorf("failed to insert token: %w", err)
 		}
 	}
+
+	return nil
+}
+
+// WithingsTokenDelete removes the user's withings token along with their sync cursor, so that relinking
+// starts again with a full sync.  Measurements already synced are kept.
+func WithingsTokenDelete(ctx context.Context, db *sql.DB, user User) error {
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	log.Print("Deleting withings token for user: ", user.UserID)
+	_, err = tx.ExecContext(ctx, "DELETE FROM withingsTokens WHERE userId=?", user.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to delete withings token: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM withingsSyncCursors WHERE userId=?", user.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to delete sync cursor: %w", err)
+	}
+
+	return tx.Commit()
 }
 
-// WithingsTokensGetAll retrieves saved withings API tokens
-func WithingsTokensGetAll(db *sql.DB) *[]WithingsToken {
+// WithingsTokensGetAll retrieves saved withings API tokens.  A token that can't be read is logged and
+// skipped, so one bad row doesn't stop everyone else from syncing.
+func WithingsTokensGetAll(ctx context.Context, db *sql.DB, keys *TokenKeys) ([]WithingsToken, error) {
 
-	rows, err := db.Query("SELECT userId, token FROM withingsTokens")
+	rows, err := db.QueryContext(ctx, "SELECT userId, token, dataKey FROM withingsTokens")
 	if err != nil {
-		log.Fatal("Failed to read all tokens: ", err)
+		return nil, fmt.Errorf("failed to read all tokens: %w", err)
 	}
 	defer rows.Close()
 
@@ -247,18 +451,27 @@ func WithingsTokensGetAll(db *sql.DB) *[]WithingsToken {
 
 		var userID string
 		var tokenStr string
+		var dataKey sql.NullString
+
+		err = rows.Scan(&userID, &tokenStr, &dataKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
 
-		err = rows.Scan(&userID, &tokenStr)
+		values, err := decryptTokens(keys, dataKey, columnAAD("withingsTokens", "dataKey", userID),
+			tokenColumn{tokenStr, columnAAD("withingsTokens", "token", userID)})
 		if err != nil {
-			log.Fatal("Failed to scan row: ", err)
+			log.Printf("Skipping undecryptable withings token for user %s: %s", userID, err)
+			continue
 		}
 
-		tokenBuf := []byte(tokenStr)
+		tokenBuf := []byte(values[0])
 		var token oauth2.Token
 
 		err = json.Unmarshal(tokenBuf, &token)
 		if err != nil {
-			log.Fatal("Failed to unmarshal token:", err)
+			log.Printf("Skipping unreadable withings token for user %s: %s", userID, err)
+			continue
 		}
 
 		t := WithingsToken{
@@ -269,58 +482,288 @@ func WithingsTokensGetAll(db *sql.DB) *[]WithingsToken {
 		tokens = append(tokens, t)
 	}
 
-	return &tokens
+	return tokens, rows.Err()
 }
 
-// Retrieves fatsecret user creds, if previously saved
-func FatSecretTokenGet(db *sql.DB, user User) (token string, secret string, exists bool) {
+// WithingsCursor is where a user's next withings sync starts from
+type WithingsCursor struct {
+	LastUpdate int64 // withings updatetime returned by the last complete sync, 0 for the full history
+
+	// a sync that stopped part way through the LastUpdate query resumes from ResumeOffset, and moves on to
+	// PendingUpdate once it's done.  A full-history query pages through the fixed window from ResumeStart to
+	// ResumeEnd, so that the offset still counts into the same measurements when it's resumed.
+	ResumeOffset  int
+	ResumeStart   int64
+	ResumeEnd     int64
+	PendingUpdate int64
+}
 
-	rows, err := db.Query("SELECT token, secret FROM fatsecretTokens where userId=?", user.UserID)
+// WithingsCursorGet retrieves where the user's last withings sync left off, if there was one
+func WithingsCursorGet(ctx context.Context, db *sql.DB, userID string) (WithingsCursor, error) {
+	var cursor WithingsCursor
 
+	err := db.QueryRowContext(ctx,
+		`SELECT lastUpdate, resumeOffset, resumeStart, resumeEnd, pendingUpdate FROM withingsSyncCursors
+		 WHERE userId=?`, userID).
+		Scan(&cursor.LastUpdate, &cursor.ResumeOffset, &cursor.ResumeStart, &cursor.ResumeEnd, &cursor.PendingUpdate)
+	if err == sql.ErrNoRows {
+		return WithingsCursor{}, ErrNotFound
+	}
 	if err != nil {
-		log.Fatal("An error occurred fetching a token: ", err)
+		return WithingsCursor{}, fmt.Errorf("failed to query for sync cursor: %w", err)
 	}
 
-	defer rows.Close()
+	return cursor, nil
+}
 
-	exists = rows.Next()
+// WithingsCursorSave saves where the user's last withings sync left off
+func WithingsCursorSave(ctx context.Context, db *sql.DB, userID string, cursor WithingsCursor) error {
+	_, err := db.ExecContext(ctx,
+		`INSERT OR REPLACE INTO withingsSyncCursors
+			(userId, lastUpdate, resumeOffset, resumeStart, resumeEnd, pendingUpdate)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		userID, cursor.LastUpdate, cursor.ResumeOffset, cursor.ResumeStart, cursor.ResumeEnd, cursor.PendingUpdate)
 
-	if exists {
+	if err != nil {
+		return fmt.Errorf("failed to save sync cursor: %w", err)
+	}
+	return nil
+}
 
-		err = rows.Scan(&token, &secret)
+// WithingsCursorReset forgets the user's last withings sync so the next sync fetches their full history
+func WithingsCursorReset(ctx context.Context, db *sql.DB, userID string) error {
+	log.Print("Resetting withings sync cursor for user: ", userID)
+	_, err := db.ExecContext(ctx, "DELETE FROM withingsSyncCursors WHERE userId=?", userID)
 
-		if err != nil {
-			log.Fatal("Failed to scan row: ", err)
-		}
+	if err != nil {
+		return fmt.Errorf("failed to reset sync cursor: %w", err)
 	}
+	return nil
+}
 
-	return token, secret, exists
+// FatSecretTokenGet retrieves fatsecret user creds, if previously saved.  keys decrypt them, and may be nil if
+// no token key is set up.
+func FatSecretTokenGet(ctx context.Context, db *sql.DB, keys *TokenKeys, user User) (token string, secret string,
+	err error) {
+
+	var dataKey sql.NullString
+	err = db.QueryRowContext(ctx, "SELECT token, secret, dataKey FROM fatsecretTokens where userId=?",
+		user.UserID).Scan(&token, &secret, &dataKey)
+	if err == sql.ErrNoRows {
+		return "", "", ErrNotFound
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("failed to query for fatsecret token: %w", err)
+	}
+
+	values, err := decryptTokens(keys, dataKey, columnAAD("fatsecretTokens", "dataKey", user.UserID),
+		tokenColumn{token, columnAAD("fatsecretTokens", "token", user.UserID)},
+		tokenColumn{secret, columnAAD("fatsecretTokens", "secret", user.UserID)})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to decrypt fatsecret token for user %s: %w", user.UserID, err)
+	}
+
+	return values[0], values[1], nil
+}
+
+// FatSecretTokenExists reports whether the user has linked FatSecret, without decrypting their creds
+func FatSecretTokenExists(ctx context.Context, db *sql.DB, user User) (bool, error) {
+	var n int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM fatsecretTokens WHERE userId=?", user.UserID).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("failed to query for fatsecret token: %w", err)
+	}
+	return n > 0, nil
+}
+
+// FatSecretLinkedAt retrieves the time the user linked FatSecret
+func FatSecretLinkedAt(ctx context.Context, db *sql.DB, userID string) (int64, error) {
+	var linkedAt int64
+
+	err := db.QueryRowContext(ctx, "SELECT linkedAt FROM fatsecretTokens WHERE userId=?", userID).Scan(&linkedAt)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to query for fatsecret link time: %w", err)
+	}
+
+	return linkedAt, nil
 }
 
+// FatSecretTokenSave saves fatsecret API tokens returned from the oauth1 process, encrypted with keys unless
+// they're nil.  A new link records the time it was made; relinking keeps it.
+func FatSecretTokenSave(ctx context.Context, db *sql.DB, keys *TokenKeys, user User, token string,
+	secret string) error {
 
-// Save fatsecret API tokens return from oauth1 process
-func FatSecretTokenSave(db *sql.DB, user User, token string, secret string) {
+	dataKey, values, err := encryptTokens(keys, columnAAD("fatsecretTokens", "dataKey", user.UserID),
+		tokenColumn{token, columnAAD("fatsecretTokens", "token", user.UserID)},
+		tokenColumn{secret, columnAAD("fatsecretTokens", "secret", user.UserID)})
+	if err != nil {
+		return fmt.Errorf("failed to encrypt token: %w", err)
+	}
+	token, secret = values[0], values[1]
+
+	exists, err := FatSecretTokenExists(ctx, db, user)
+	if err != nil {
+		return err
+	}
 
-	_, _, exists := FatSecretTokenGet(db, user)
 	if exists {
 		// replace the existing token
 		log.Print("Updating fatsecret tokens for user: ", user.UserID)
-		_, err := db.Exec("UPDATE fatsecretTokens SET token=?, secret=? WHERE userId=?", token, secret,
-						  user.UserID)
+		_, err = db.ExecContext(ctx, "UPDATE fatsecretTokens SET token=?, secret=?, dataKey=? WHERE userId=?",
+			token, secret, dataKey, user.UserID)
 
 		if err != nil {
-			log.Fatal("Failed to update token value: ", err)
+			return fmt.Errorf("failed to update token value: %w", err)
 		}
 	} else {
 		// insert a new token record
 		log.Print("Saving new fatsecret token for user: ", user.UserID)
-		_, err := db.Exec("INSERT INTO fatsecretTokens (userId, token, secret) VALUES (?, ?, ?)", user.UserID,
-								token, secret)
+		_, err = db.ExecContext(ctx,
+			"INSERT INTO fatsecretTokens (userId, token, secret, dataKey, linkedAt) VALUES (?, ?, ?, ?, ?)",
+			user.UserID, token, secret, dataKey, time.Now().Unix())
+
+		if err != nil {
+			return fmt.Errorf("failed to insert token: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// FatSecretTokenDelete removes the user's fatsecret creds, along with the copy of their FatSecret weight
+// history.  The record of weights already pushed is kept so that relinking doesn't post them again.
+func FatSecretTokenDelete(ctx context.Context, db *sql.DB, user User) error {
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	log.Print("Deleting fatsecret tokens for user: ", user.UserID)
+	_, err = tx.ExecContext(ctx, "DELETE FROM fatsecretTokens WHERE userId=?", user.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to delete fatsecret token: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM fatsecretSyncCursors WHERE userId=?", user.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to delete sync cursor: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM measurements WHERE userId=? AND source=?", user.UserID,
+		SourceFatSecret)
+	if err != nil {
+		return fmt.Errorf("failed to delete fatsecret measurements: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// FatSecretCursorGet retrieves the time of the user's last fatsecret history sync, if there was one
+func FatSecretCursorGet(ctx context.Context, db *sql.DB, userID string) (int64, error) {
+	var lastSync int64
 
+	err := db.QueryRowContext(ctx, "SELECT lastSync FROM fatsecretSyncCursors WHERE userId=?", userID).
+		Scan(&lastSync)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to query for sync cursor: %w", err)
+	}
+
+	return lastSync, nil
+}
+
+// FatSecretCursorSave saves the time of the user's latest fatsecret history sync
+func FatSecretCursorSave(ctx context.Context, db *sql.DB, userID string, lastSync int64) error {
+	_, err := db.ExecContext(ctx, "INSERT OR REPLACE INTO fatsecretSyncCursors (userId, lastSync) VALUES (?, ?)",
+		userID, lastSync)
+
+	if err != nil {
+		return fmt.Errorf("failed to save sync cursor: %w", err)
+	}
+	return nil
+}
+
+// FatSecretDayPushesGet retrieves the weight last pushed to FatSecret for each day, keyed by FatSecret day
+// number (days since 1970)
+func FatSecretDayPushesGet(ctx context.Context, db *sql.DB, userID string) (map[int64]Weight, error) {
+
+	rows, err := db.QueryContext(ctx, "SELECT date, value, unit FROM fatsecretDayPushes WHERE userId=?", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for day pushes: %w", err)
+	}
+	defer rows.Close()
+
+	pushes := make(map[int64]Weight)
+
+	for rows.Next() {
+		var day int64
+		var weight Weight
+		err = rows.Scan(&day, &weight.Value, &weight.Unit)
 		if err != nil {
-			log.Fatal("Failed to insert token: ", err)
+			return nil, fmt.Errorf("failed to scan row: %w", err)
 		}
+		pushes[day] = weight
+	}
+
+	return pushes, rows.Err()
+}
+
+// FatSecretDayPushSave records the weight pushed to FatSecret for a day, replacing any earlier one
+func FatSecretDayPushSave(ctx context.Context, db *sql.DB, userID string, day int64, weight Weight) error {
+	_, err := db.ExecContext(ctx,
+		"INSERT OR REPLACE INTO fatsecretDayPushes (userId, date, value, unit) VALUES (?, ?, ?, ?)",
+		userID, day, weight.Value, weight.Unit)
+
+	if err != nil {
+		return fmt.Errorf("failed to save day push: %w", err)
+	}
+	return nil
+}
+
+// OAuthRequestTokenGet retrieves the oauth1 request token the user is authorizing with a provider.  Request
+// tokens are kept in plaintext: they are single use, short lived and useless without the user's approval.
+func OAuthRequestTokenGet(ctx context.Context, db *sql.DB, userID string, provider string) (token string,
+	secret string, expires time.Time, err error) {
+
+	var expiresUnix int64
+	err = db.QueryRowContext(ctx, "SELECT token, secret, expires FROM oauthRequestTokens WHERE userId=? AND provider=?",
+		userID, provider).Scan(&token, &secret, &expiresUnix)
+	if err == sql.ErrNoRows {
+		return "", "", time.Time{}, ErrNotFound
+	}
+	if err != nil {
+		return "", "", time.Time{}, fmt.Errorf("failed to query for request token: %w", err)
 	}
 
+	return token, secret, time.Unix(expiresUnix, 0), nil
 }
 
+// OAuthRequestTokenSave saves the request token for the user's authorization with a provider, replacing any
+// earlier one
+func OAuthRequestTokenSave(ctx context.Context, db *sql.DB, userID string, provider string, token string,
+	secret string, expires time.Time) error {
+
+	_, err := db.ExecContext(ctx, `INSERT OR REPLACE INTO oauthRequestTokens (userId, provider, token, secret, expires)
+		VALUES (?, ?, ?, ?, ?)`, userID, provider, token, secret, expires.Unix())
+	if err != nil {
+		return fmt.Errorf("failed to save request token: %w", err)
+	}
+	return nil
+}
+
+// OAuthRequestTokenDelete deletes the user's request token for a provider, once used
+func OAuthRequestTokenDelete(ctx context.Context, db *sql.DB, userID string, provider string) error {
+
+	_, err := db.ExecContext(ctx, "DELETE FROM oauthRequestTokens WHERE userId=? AND provider=?", userID, provider)
+	if err != nil {
+		return fmt.Errorf("failed to delete request token: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// user names are unique among accounts with a password, enforced by the insert itself
+func TestUserCreate(t *testing.T) {
+
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	err := Migrate(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// from before password logins: doesn't hold the name
+	execAll(t, db, `INSERT INTO users (userId, userName) VALUES ('u0', 'amy')`)
+
+	err = UserCreate(ctx, db, User{UserID: "u1", UserName: "amy", PasswordHash: "hash"})
+	if err != nil {
+		t.Fatalf("UserCreate: %s", err)
+	}
+
+	err = UserCreate(ctx, db, User{UserID: "u2", UserName: "amy", PasswordHash: "other hash"})
+	if err != ErrExists {
+		t.Errorf("taken user name: got %v, want %v", err, ErrExists)
+	}
+
+	err = UserCreate(ctx, db, User{UserID: "u1", UserName: "bob", PasswordHash: "hash"})
+	if err == nil || err == ErrExists {
+		t.Errorf("taken user id: got %v, want an insert error", err)
+	}
+
+	n := count(t, db, `SELECT COUNT(*) FROM users`)
+	if n != 2 {
+		t.Errorf("%d users, want 2", n)
+	}
+}
+
+// a new link records when it was made, and relinking keeps the time
+func TestFatSecretLinkedAt(t *testing.T) {
+
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	err := Migrate(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := User{UserID: "u1", UserName: "amy"}
+	execAll(t, db, `INSERT INTO users (userId, userName) VALUES ('u1', 'amy')`)
+
+	_, err = FatSecretLinkedAt(ctx, db, user.UserID)
+	if err != ErrNotFound {
+		t.Errorf("before linking: got %v, want %v", err, ErrNotFound)
+	}
+
+	before := time.Now().Unix()
+	err = FatSecretTokenSave(ctx, db, nil, user, "token", "secret")
+	if err != nil {
+		t.Fatalf("FatSecretTokenSave: %s", err)
+	}
+
+	linkedAt, err := FatSecretLinkedAt(ctx, db, user.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linkedAt < before || linkedAt > time.Now().Unix() {
+		t.Errorf("linked at %d, want the time of linking", linkedAt)
+	}
+
+	execAll(t, db, `UPDATE fatsecretTokens SET linkedAt = 100`)
+	err = FatSecretTokenSave(ctx, db, nil, user, "new token", "new secret")
+	if err != nil {
+		t.Fatalf("FatSecretTokenSave: %s", err)
+	}
+
+	linkedAt, err = FatSecretLinkedAt(ctx, db, user.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linkedAt != 100 {
+		t.Errorf("relinking changed the link time to %d", linkedAt)
+	}
+}
+
+// deleting a user empties every table of their rows and leaves other users' alone
+func TestUserDelete(t *testing.T) {
+
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	err := Migrate(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tables := make(map[string]bool)
+	for _, table := range userTables {
+		tables[table] = true
+	}
+
+	rows, err := db.Query(`SELECT m.name FROM sqlite_master m, pragma_table_info(m.name) c
+		WHERE m.type = 'table' AND c.name = 'userId'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withUserID := make([]string, 0)
+	for rows.Next() {
+		var table string
+		err = rows.Scan(&table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		withUserID = append(withUserID, table)
+		if !tables[table] {
+			t.Errorf("table %s holds user data but isn't in userTables", table)
+		}
+	}
+	rows.Close()
+
+	for _, userID := range []string{"u1", "u2"} {
+		execAll(t, db,
+			`INSERT INTO users (userId, userName) VALUES ('`+userID+`', '`+userID+`')`,
+			`INSERT INTO measurements (userId, source, groupId, type, value, unit, timestamp)
+				VALUES ('`+userID+`', 'withings', 1, 1, 80000, -3, 1500000000)`,
+			`INSERT INTO fatsecretPushes (userId, timestamp) VALUES ('`+userID+`', 1500000000)`,
+			`INSERT INTO fatsecretDayPushes (userId, date, value, unit) VALUES ('`+userID+`', 17000, 80000, -3)`,
+			`INSERT INTO withingsSyncCursors (userId, lastUpdate) VALUES ('`+userID+`', 1500000000)`,
+			`INSERT INTO fatsecretSyncCursors (userId, lastSync) VALUES ('`+userID+`', 1500000000)`,
+			`INSERT INTO withingsTokens (userId, token) VALUES ('`+userID+`', 'token')`,
+			`INSERT INTO fatsecretTokens (userId, token, secret) VALUES ('`+userID+`', 'token', 'secret')`,
+			`INSERT INTO oauthRequestTokens (userId, provider, token, secret, expires)
+				VALUES ('`+userID+`', 'fatsecret', 'token', 'secret', 0)`,
+			`INSERT INTO userSettings (userId, name, value) VALUES ('`+userID+`', 'syncInterval', '6h')`,
+		)
+	}
+
+	err = UserDelete(ctx, db, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range withUserID {
+		n := count(t, db, "SELECT COUNT(*) FROM "+table+" WHERE userId = 'u1'")
+		if n != 0 {
+			t.Errorf("%s: %d rows left for the deleted user", table, n)
+		}
+		n = count(t, db, "SELECT COUNT(*) FROM "+table+" WHERE userId = 'u2'")
+		if n != 1 {
+			t.Errorf("%s: %d rows for the other user, want 1", table, n)
+		}
+	}
+}
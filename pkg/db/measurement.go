@@ -0,0 +1,182 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+)
+
+// MeasureType identifies what a measurement measures, using the Withings measure type codes
+type MeasureType int
+
+// Measure types
+const (
+	MeasureWeight            MeasureType = 1  // kg
+	MeasureHeight            MeasureType = 4  // m
+	MeasureFatFreeMass       MeasureType = 5  // kg
+	MeasureFatRatio          MeasureType = 6  // %
+	MeasureFatMass           MeasureType = 8  // kg
+	MeasureDiastolicBP       MeasureType = 9  // mmHg
+	MeasureSystolicBP        MeasureType = 10 // mmHg
+	MeasureHeartRate         MeasureType = 11 // bpm
+	MeasureTemperature       MeasureType = 12 // celsius
+	MeasureSpO2              MeasureType = 54 // %
+	MeasureBodyTemperature   MeasureType = 71 // celsius
+	MeasureSkinTemperature   MeasureType = 73 // celsius
+	MeasureMuscleMass        MeasureType = 76 // kg
+	MeasureHydration         MeasureType = 77 // kg
+	MeasureBoneMass          MeasureType = 88 // kg
+	MeasurePulseWaveVelocity MeasureType = 91 // m/s
+)
+
+var measureTypeNames = map[MeasureType]string{
+	MeasureWeight:            "weight",
+	MeasureHeight:            "height",
+	MeasureFatFreeMass:       "fat free mass",
+	MeasureFatRatio:          "fat ratio",
+	MeasureFatMass:           "fat mass",
+	MeasureDiastolicBP:       "diastolic blood pressure",
+	MeasureSystolicBP:        "systolic blood pressure",
+	MeasureHeartRate:         "heart rate",
+	MeasureTemperature:       "temperature",
+	MeasureSpO2:              "SpO2",
+	MeasureBodyTemperature:   "body temperature",
+	MeasureSkinTemperature:   "skin temperature",
+	MeasureMuscleMass:        "muscle mass",
+	MeasureHydration:         "hydration",
+	MeasureBoneMass:          "bone mass",
+	MeasurePulseWaveVelocity: "pulse wave velocity",
+}
+
+func (t MeasureType) String() string {
+	name, known := measureTypeNames[t]
+	if !known {
+		return "unknown"
+	}
+	return name
+}
+
+// Sources of measurements
+const (
+	SourceWithings  = "withings"
+	SourceFatSecret = "fatsecret" // FatSecret's own weight history, one weight per day
+)
+
+// Measurement DB model.  The measured value is Value * 10^Unit, kept as the integer pair the API returned
+// so no precision is lost.
+type Measurement struct {
+	Source    string
+	GroupID   int64 // measurements taken together share a group
+	Type      MeasureType
+	Value     int64
+	Unit      int
+	Timestamp int64 // epoch time (secs since 1970)
+}
+
+// Float returns the measured value as a float
+func (m Measurement) Float() float64 {
+	return float64(m.Value) * math.Pow10(m.Unit)
+}
+
+// MeasurementsSync saves a number of measurements for the user.  A measurement already saved for the same
+// source, group and type is replaced, so updated groups overwrite their earlier values.
+func MeasurementsSync(ctx context.Context, db *sql.DB, userID string, measurements []Measurement) error {
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = saveMeasurements(ctx, tx, userID, measurements)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MeasurementsSyncRange replaces the user's measurements from source taken in [start, end) with the given
+// ones, for sources that report everything in a time range at once
+func MeasurementsSyncRange(ctx context.Context, db *sql.DB, userID string, source string, start int64,
+	end int64, measurements []Measurement) error {
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		"DELETE FROM measurements WHERE userId=? AND source=? AND timestamp >= ? AND timestamp < ?",
+		userID, source, start, end)
+	if err != nil {
+		return fmt.Errorf("failed to delete measurements: %w", err)
+	}
+
+	err = saveMeasurements(ctx, tx, userID, measurements)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func saveMeasurements(ctx context.Context, tx *sql.Tx, userID string, measurements []Measurement) error {
+
+	for _, m := range measurements {
+		_, err := tx.ExecContext(ctx,
+			`INSERT OR REPLACE INTO measurements (userId, source, groupId, type, value, unit, timestamp)
+				VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			userID, m.Source, m.GroupID, m.Type, m.Value, m.Unit, m.Timestamp)
+
+		if err != nil {
+			return fmt.Errorf("failed to save measurement: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// MeasurementsGet retrieves the user's measurements of a type from a source, oldest first
+func MeasurementsGet(ctx context.Context, db *sql.DB, userID string, source string,
+	measureType MeasureType) ([]Measurement, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT source, groupId, type, value, unit, timestamp FROM measurements
+			WHERE userId=? AND source=? AND type=? ORDER BY timestamp, groupId`, userID, source, measureType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for measurements: %w", err)
+	}
+	defer rows.Close()
+
+	return scanMeasurements(rows)
+}
+
+// MeasurementsGetAll retrieves all of the user's measurements, oldest first
+func MeasurementsGetAll(ctx context.Context, db *sql.DB, userID string) ([]Measurement, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT source, groupId, type, value, unit, timestamp FROM measurements
+			WHERE userId=? ORDER BY timestamp, source, groupId, type`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query for measurements: %w", err)
+	}
+	defer rows.Close()
+
+	return scanMeasurements(rows)
+}
+
+func scanMeasurements(rows *sql.Rows) ([]Measurement, error) {
+	measurements := make([]Measurement, 0)
+
+	for rows.Next() {
+		var m Measurement
+		err := rows.Scan(&m.Source, &m.GroupID, &m.Type, &m.Value, &m.Unit, &m.Timestamp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		measurements = append(measurements, m)
+	}
+
+	return measurements, rows.Err()
+}
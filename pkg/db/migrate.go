@@ -0,0 +1,312 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Migration is a versioned change to the schema
+type Migration struct {
+	Version     int
+	Description string
+	Statements  []string
+}
+
+// migrations, in the order they're applied.  Never edit a migration once released, add a new one instead.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "initial schema",
+		// IF NOT EXISTS adopts databases created before migrations were tracked
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS users
+					(userId TEXT NOT NULL PRIMARY KEY,
+					 userName TEXT NOT NULL)`,
+
+			// token is a json-encoded oauth2.Token
+			`CREATE TABLE IF NOT EXISTS withingsTokens
+					(id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+					 userId TEXT NOT NULL,
+					 token TEXT NOT NULL,
+					 FOREIGN KEY(userId) REFERENCES users(userId))`,
+
+			// token and secret are oauth1 string values
+			`CREATE TABLE IF NOT EXISTS fatsecretTokens
+					(id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+					 userId TEXT NOT NULL,
+					 token TEXT NOT NULL,
+					 secret TEXT NOT NULL,
+					 FOREIGN KEY(userId) REFERENCES users(userId))`,
+
+			// the measured value is value * 10^unit
+			`CREATE TABLE IF NOT EXISTS measurements
+					(id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+					 userId TEXT NOT NULL,
+					 groupId INTEGER NOT NULL,
+					 type INTEGER NOT NULL,
+					 value INTEGER NOT NULL,
+					 unit INTEGER NOT NULL,
+					 timestamp INTEGER NOT NULL,
+					 UNIQUE(userId, groupId, type),
+					 FOREIGN KEY(userId) REFERENCES users(userId))`,
+
+			// lastUpdate is the withings updatetime returned by the last successful sync
+			`CREATE TABLE IF NOT EXISTS withingsSyncCursors
+					(userId TEXT NOT NULL PRIMARY KEY,
+					 lastUpdate INTEGER NOT NULL,
+					 FOREIGN KEY(userId) REFERENCES users(userId))`,
+
+			`CREATE TABLE IF NOT EXISTS userSettings
+					(userId TEXT NOT NULL,
+					 name TEXT NOT NULL,
+					 value TEXT NOT NULL,
+					 PRIMARY KEY(userId, name),
+					 FOREIGN KEY(userId) REFERENCES users(userId))`,
+
+			// timestamp matches the timestamp of the pushed weight measurement
+			`CREATE TABLE IF NOT EXISTS fatsecretPushes
+					(id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+					 userId TEXT NOT NULL,
+					 timestamp INTEGER NOT NULL,
+					 FOREIGN KEY(userId) REFERENCES users(userId))`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "replace the old pounds weights table with a view over weight measurements",
+		// the old table's rows are discarded, not copied: they were rounded pound values without their
+		// Withings group ids, and the first sync after upgrading fetches the full history again in kg.  which
+		// weights were pushed to FatSecret is kept in fatsecretPushes, so none are pushed again.
+		Statements: []string{
+			`DROP TABLE IF EXISTS weights`,
+			`CREATE VIEW weights AS
+					SELECT id, userId, value, unit, timestamp FROM measurements WHERE type = 1`,
+		},
+	},
+	{
+		Version:     3,
+		Description: "one token per user, and index lookups by user",
+		// older databases can hold duplicates the unique indexes would reject: keep the newest row of each
+		Statements: []string{
+			`DELETE FROM withingsTokens WHERE id NOT IN (SELECT MAX(id) FROM withingsTokens GROUP BY userId)`,
+			`CREATE UNIQUE INDEX withingsTokensUserId ON withingsTokens(userId)`,
+			`DELETE FROM fatsecretTokens WHERE id NOT IN (SELECT MAX(id) FROM fatsecretTokens GROUP BY userId)`,
+			`CREATE UNIQUE INDEX fatsecretTokensUserId ON fatsecretTokens(userId)`,
+			`DELETE FROM fatsecretPushes
+					WHERE id NOT IN (SELECT MAX(id) FROM fatsecretPushes GROUP BY userId, timestamp)`,
+			`CREATE UNIQUE INDEX fatsecretPushesUserTimestamp ON fatsecretPushes(userId, timestamp)`,
+			`CREATE INDEX measurementsUserTypeTimestamp ON measurements(userId, type, timestamp)`,
+		},
+	},
+	{
+		Version:     4,
+		Description: "password logins",
+		// accounts from before passwords have no hash and can't log in; user names only need to be unique
+		// among accounts that can
+		Statements: []string{
+			`ALTER TABLE users ADD COLUMN passwordHash TEXT`,
+			`CREATE UNIQUE INDEX usersUserName ON users(userName) WHERE passwordHash IS NOT NULL`,
+		},
+	},
+	{
+		Version:     5,
+		Description: "tag measurements with the service they came from, to hold FatSecret's weight history",
+		// sqlite can't change a table's constraints, so the measurements table is rebuilt with the source
+		// in its unique key.  the weights view still only covers Withings.
+		Statements: []string{
+			`DROP VIEW weights`,
+			`CREATE TABLE measurementsNew
+					(id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+					 userId TEXT NOT NULL,
+					 source TEXT NOT NULL,
+					 groupId INTEGER NOT NULL,
+					 type INTEGER NOT NULL,
+					 value INTEGER NOT NULL,
+					 unit INTEGER NOT NULL,
+					 timestamp INTEGER NOT NULL,
+					 UNIQUE(userId, source, groupId, type),
+					 FOREIGN KEY(userId) REFERENCES users(userId))`,
+			`INSERT INTO measurementsNew (id, userId, source, groupId, type, value, unit, timestamp)
+					SELECT id, userId, 'withings', groupId, type, value, unit, timestamp FROM measurements`,
+			`DROP TABLE measurements`,
+			`ALTER TABLE measurementsNew RENAME TO measurements`,
+			`CREATE INDEX measurementsUserTypeTimestamp ON measurements(userId, type, timestamp)`,
+			`CREATE VIEW weights AS
+					SELECT id, userId, value, unit, timestamp FROM measurements
+					WHERE type = 1 AND source = 'withings'`,
+			`CREATE TABLE fatsecretSyncCursors
+					(userId TEXT NOT NULL PRIMARY KEY,
+					 lastSync INTEGER NOT NULL,
+					 FOREIGN KEY(userId) REFERENCES users(userId))`,
+		},
+	},
+	{
+		Version:     6,
+		Description: "remember the weight pushed to FatSecret for each day, to spot edits made in FatSecret",
+		// date is FatSecret's day number, days since 1970
+		Statements: []string{
+			`CREATE TABLE fatsecretDayPushes
+					(userId TEXT NOT NULL,
+					 date INTEGER NOT NULL,
+					 value INTEGER NOT NULL,
+					 unit INTEGER NOT NULL,
+					 PRIMARY KEY(userId, date),
+					 FOREIGN KEY(userId) REFERENCES users(userId))`,
+		},
+	},
+	{
+		Version:     7,
+		Description: "keep oauth1 request tokens server side while the user authorizes the app",
+		// provider is e.g. 'fatsecret', expires is a unix time
+		Statements: []string{
+			`CREATE TABLE oauthRequestTokens
+					(userId TEXT NOT NULL,
+					 provider TEXT NOT NULL,
+					 token TEXT NOT NULL,
+					 secret TEXT NOT NULL,
+					 expires INTEGER NOT NULL,
+					 PRIMARY KEY(userId, provider),
+					 FOREIGN KEY(userId) REFERENCES users(userId))`,
+		},
+	},
+	{
+		Version:     8,
+		Description: "resume withings syncs that stopped part way through a long history",
+		// a resumeOffset above 0 means the lastUpdate query is still being paged through; pendingUpdate is the
+		// updatetime to move on to once it's done
+		Statements: []string{
+			`ALTER TABLE withingsSyncCursors ADD COLUMN resumeOffset INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE withingsSyncCursors ADD COLUMN pendingUpdate INTEGER NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		Version:     9,
+		Description: "per-row data keys for token encryption",
+		// dataKey is the key a row's tokens are sealed with, itself sealed by the token key.  NULL for rows
+		// still in plaintext.
+		Statements: []string{
+			`ALTER TABLE withingsTokens ADD COLUMN dataKey TEXT`,
+			`ALTER TABLE fatsecretTokens ADD COLUMN dataKey TEXT`,
+		},
+	},
+	{
+		Version:     10,
+		Description: "remember when FatSecret was linked, so weigh-ins from before aren't pushed",
+		// links from before this migration count as made now: their earlier weigh-ins were pushed already, or
+		// are history the user didn't ask to have pushed
+		Statements: []string{
+			`ALTER TABLE fatsecretTokens ADD COLUMN linkedAt INTEGER NOT NULL DEFAULT 0`,
+			`UPDATE fatsecretTokens SET linkedAt = CAST(strftime('%s', 'now') AS INTEGER)`,
+		},
+	},
+	{
+		Version:     11,
+		Description: "keep the window a resumed withings full-history sync pages through",
+		// resumeStart and resumeEnd are the startdate and enddate the offset counts into, 0 for incremental
+		// syncs.  a full-history sync saved without them starts over.
+		Statements: []string{
+			`ALTER TABLE withingsSyncCursors ADD COLUMN resumeStart INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE withingsSyncCursors ADD COLUMN resumeEnd INTEGER NOT NULL DEFAULT 0`,
+		},
+	},
+}
+
+// tracks applied migrations, one row per version
+const createSchemaVersion = `CREATE TABLE IF NOT EXISTS schema_version
+					(version INTEGER NOT NULL PRIMARY KEY,
+					 description TEXT NOT NULL,
+					 appliedAt INTEGER NOT NULL)`
+
+// SchemaVersion returns the version of the last migration applied to the db, 0 if none.  The db is not
+// modified, so this is safe for a dry run.
+func SchemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+
+	var tables int
+	err := db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='schema_version'").Scan(&tables)
+	if err != nil {
+		return 0, fmt.Errorf("failed to look for schema_version table: %w", err)
+	}
+	if tables == 0 {
+		return 0, nil
+	}
+
+	var version int
+	err = db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	return version, nil
+}
+
+// PendingMigrations returns the migrations not yet applied to the db, in order
+func PendingMigrations(ctx context.Context, db *sql.DB) ([]Migration, error) {
+
+	version, err := SchemaVersion(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make([]Migration, 0)
+	for _, m := range migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+
+	return pending, nil
+}
+
+// Migrate applies all pending migrations.  Each migration runs in its own transaction, so a failure leaves
+// the db at the last migration that succeeded.
+func Migrate(ctx context.Context, db *sql.DB) error {
+
+	_, err := db.ExecContext(ctx, createSchemaVersion)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_version table: %w", err)
+	}
+
+	pending, err := PendingMigrations(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range pending {
+		log.Printf("Applying migration %d: %s", m.Version, m.Description)
+
+		err = applyMigration(ctx, db, m)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Description, err)
+		}
+	}
+
+	return nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, m Migration) error {
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range m.Statements {
+		_, err = tx.ExecContext(ctx, statement)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO schema_version (version, description, appliedAt) VALUES (?, ?, ?)",
+		m.Version, m.Description, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
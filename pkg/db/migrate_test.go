@@ -0,0 +1,151 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+
+	db, err := Open(filepath.Join(t.TempDir(), "wfsync.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func execAll(t *testing.T, db *sql.DB, statements ...string) {
+	for _, statement := range statements {
+		_, err := db.Exec(statement)
+		if err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+	}
+}
+
+func count(t *testing.T, db *sql.DB, query string) int {
+	var n int
+	err := db.QueryRow(query).Scan(&n)
+	if err != nil {
+		t.Fatalf("%s: %s", query, err)
+	}
+	return n
+}
+
+// databases from before migrations could hold duplicate tokens and pushes
+func TestMigrateDuplicates(t *testing.T) {
+
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	execAll(t, db, createSchemaVersion)
+	for _, m := range migrations[:2] {
+		err := applyMigration(ctx, db, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	execAll(t, db,
+		`INSERT INTO users (userId, userName) VALUES ('u1', 'amy')`,
+		`INSERT INTO withingsTokens (userId, token) VALUES ('u1', 'old'), ('u1', 'new')`,
+		`INSERT INTO fatsecretTokens (userId, token, secret) VALUES ('u1', 'old', 's'), ('u1', 'new', 's')`,
+		`INSERT INTO fatsecretPushes (userId, timestamp) VALUES ('u1', 100), ('u1', 100), ('u1', 200)`,
+	)
+
+	err := Migrate(ctx, db)
+	if err != nil {
+		t.Fatalf("Migrate: %s", err)
+	}
+
+	if n := count(t, db, `SELECT COUNT(*) FROM withingsTokens WHERE token = 'new'`); n != 1 {
+		t.Errorf("%d newest withings tokens kept, want 1", n)
+	}
+	if n := count(t, db, `SELECT COUNT(*) FROM fatsecretTokens`); n != 1 {
+		t.Errorf("%d fatsecret tokens, want 1", n)
+	}
+	// a link from before link times were kept counts as made at the upgrade
+	if n := count(t, db, `SELECT COUNT(*) FROM fatsecretTokens WHERE linkedAt > 0`); n != 1 {
+		t.Errorf("%d fatsecret links with a link time, want 1", n)
+	}
+	if n := count(t, db, `SELECT COUNT(*) FROM fatsecretPushes`); n != 2 {
+		t.Errorf("%d pushes, want 2", n)
+	}
+}
+
+// weight groups measured at the same time are pushed once
+func TestWeightPushedSaveTwice(t *testing.T) {
+
+	ctx := context.Background()
+	db := openTestDB(t)
+
+	err := Migrate(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	execAll(t, db, `INSERT INTO users (userId, userName) VALUES ('u1', 'amy')`)
+
+	weight := Weight{Value: 805, Unit: -1, Timestamp: 100}
+	for i := 0; i < 2; i++ {
+		err = WeightPushedSave(ctx, db, "u1", weight)
+		if err != nil {
+			t.Fatalf("WeightPushedSave %d: %s", i, err)
+		}
+	}
+
+	if n := count(t, db, `SELECT COUNT(*) FROM fatsecretPushes`); n != 1 {
+		t.Errorf("%d pushes, want 1", n)
+	}
+}
+
+// a dry run reads the db without creating or changing it
+func TestOpenReadOnly(t *testing.T) {
+
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	missing := filepath.Join(dir, "missing", "wfsync.db")
+	_, err := OpenReadOnly(missing)
+	if err == nil {
+		t.Error("opened a db that doesn't exist")
+	}
+	_, err = os.Stat(filepath.Dir(missing))
+	if !os.IsNotExist(err) {
+		t.Errorf("opening read only created the db dir: %v", err)
+	}
+
+	path := filepath.Join(dir, "wfsync #1.db")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	execAll(t, db, createSchemaVersion)
+	err = applyMigration(ctx, db, migrations[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	readOnly, err := OpenReadOnly(path)
+	if err != nil {
+		t.Fatalf("OpenReadOnly: %s", err)
+	}
+	defer readOnly.Close()
+
+	pending, err := PendingMigrations(ctx, readOnly)
+	if err != nil {
+		t.Fatalf("PendingMigrations: %s", err)
+	}
+	if len(pending) != len(migrations)-1 {
+		t.Errorf("%d pending migrations, want %d", len(pending), len(migrations)-1)
+	}
+
+	_, err = readOnly.Exec(`INSERT INTO users (userId, userName) VALUES ('u1', 'amy')`)
+	if err == nil {
+		t.Error("wrote to a db opened read only")
+	}
+}
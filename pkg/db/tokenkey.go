@@ -0,0 +1,507 @@
+package db
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// OAuth tokens are encrypted at rest with envelope encryption.  Each token row has its own random data key,
+// which seals the row's token columns with AES-256-GCM.  The data key is saved in the row's dataKey column,
+// itself sealed by the token key (the key-encryption key) as "v1:<key id>:<base64 nonce+ciphertext>", where
+// the key id says which token key sealed it.  Sealed token columns are "v1:<base64 nonce+ciphertext>".
+//
+// Rotating the token key only re-seals the data keys.  Rows without a data key hold plaintext tokens saved
+// by versions from before encryption; they are still read, and are encrypted when the first key is created.
+
+const (
+	// TokenKeyEnv names the env var holding the base64-encoded token key, used instead of the key file
+	TokenKeyEnv = "WFSYNC_TOKEN_KEY"
+
+	tokenKeyLength = 32 // AES-256, for token keys and data keys alike
+
+	encryptedPrefix = "v1:"
+
+	// a rotation writes the new key next to the key file under this suffix until every data key is sealed
+	// with it
+	pendingKeySuffix = ".new"
+)
+
+// ErrNoTokenKey is returned when an encrypted token is read but no token encryption key has been set up
+var ErrNoTokenKey = errors.New("no token encryption key: set " + TokenKeyEnv +
+	" or start wfsync to create the key file")
+
+// TokenKey is a key sealing the data keys OAuth tokens are encrypted with
+type TokenKey struct {
+	ID  string // identifies the key in encrypted values, derived from the key
+	key []byte
+}
+
+// TokenKeys holds the key new data keys are sealed with, plus any others that data keys may still be sealed
+// with.  The token accessors take a nil *TokenKeys when no key is set up, and then save tokens in plaintext.
+type TokenKeys struct {
+	current *TokenKey
+	byID    map[string]*TokenKey
+}
+
+func newTokenKey(key []byte) (*TokenKey, error) {
+	if len(key) != tokenKeyLength {
+		return nil, fmt.Errorf("token key must be %d bytes, got %d", tokenKeyLength, len(key))
+	}
+	sum := sha256.Sum256(key)
+	return &TokenKey{ID: hex.EncodeToString(sum[:4]), key: key}, nil
+}
+
+// NewTokenKeys creates a key ring encrypting with current and able to decrypt with any of the keys
+func NewTokenKeys(current *TokenKey, others ...*TokenKey) *TokenKeys {
+	keys := &TokenKeys{
+		current: current,
+		byID:    map[string]*TokenKey{current.ID: current},
+	}
+	for _, key := range others {
+		keys.byID[key.ID] = key
+	}
+	return keys
+}
+
+// GenerateTokenKey creates a new random token key and writes it to path, failing if the file already exists.
+// The key is written to a temporary file first, so path never holds a partly written key.
+func GenerateTokenKey(path string) (*TokenKey, error) {
+
+	buf := make([]byte, tokenKeyLength)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token key: %w", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create token key dir: %w", err)
+	}
+
+	// TempFile creates a fresh file, readable only by its owner
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create token key file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write token key: %w", err)
+	}
+
+	// unlike a rename, a link never replaces an existing key
+	err = os.Link(f.Name(), path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save token key: %w", err)
+	}
+
+	return newTokenKey(buf)
+}
+
+// LoadTokenKeys loads the token key from the env var, or else the key file at path.  A key left over from an
+// interrupted rotation is loaded too, so values it already encrypted can still be read.
+func LoadTokenKeys(path string) (*TokenKeys, error) {
+
+	var current *TokenKey
+	var err error
+
+	if encoded := os.Getenv(TokenKeyEnv); encoded != "" {
+		buf, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", TokenKeyEnv, err)
+		}
+		current, err = newTokenKey(buf)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s: %w", TokenKeyEnv, err)
+		}
+	} else {
+		current, err = readTokenKey(path)
+		if os.IsNotExist(err) {
+			return nil, ErrNoTokenKey
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pending, err := readTokenKey(path + pendingKeySuffix)
+	if os.IsNotExist(err) {
+		return NewTokenKeys(current), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Found %s%s from an interrupted key rotation, run `wfsync rotate-token-key` again", path,
+		pendingKeySuffix)
+	return NewTokenKeys(current, pending), nil
+}
+
+func readTokenKey(path string) (*TokenKey, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := newTokenKey(buf)
+	if err != nil {
+		return nil, fmt.Errorf("bad token key file %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// a row's token column to seal or open, with the additional authenticated data binding it to its column and
+// user, so a sealed value copied to another row or column won't open
+type tokenColumn struct {
+	value string
+	aad   string
+}
+
+// encrypt a row's token columns under a new data key, returning the sealed data key and the sealed values in
+// the order given.  With no token key the values are returned as is, with no data key.
+func encryptTokens(keys *TokenKeys, dataKeyAAD string, columns ...tokenColumn) (sql.NullString, []string,
+	error) {
+
+	values := make([]string, 0, len(columns))
+
+	if keys == nil {
+		for _, column := range columns {
+			values = append(values, column.value)
+		}
+		return sql.NullString{}, values, nil
+	}
+
+	dataKey := make([]byte, tokenKeyLength)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return sql.NullString{}, nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	for _, column := range columns {
+		sealed, err := seal(dataKey, []byte(column.value), column.aad)
+		if err != nil {
+			return sql.NullString{}, nil, err
+		}
+		values = append(values, encryptedPrefix+sealed)
+	}
+
+	wrapped, err := wrapDataKey(keys.current, dataKey, dataKeyAAD)
+	if err != nil {
+		return sql.NullString{}, nil, err
+	}
+
+	return sql.NullString{String: wrapped, Valid: true}, values, nil
+}
+
+// decrypt a row's token columns, returning the plaintext values in the order given.  A row without a data key
+// holds plaintext tokens saved before encryption was set up, which are passed through.
+func decryptTokens(keys *TokenKeys, dataKey sql.NullString, dataKeyAAD string,
+	columns ...tokenColumn) ([]string, error) {
+
+	values := make([]string, 0, len(columns))
+
+	if !dataKey.Valid {
+		for _, column := range columns {
+			values = append(values, column.value)
+		}
+		return values, nil
+	}
+
+	key, err := unwrapDataKey(keys, dataKey.String, dataKeyAAD)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, column := range columns {
+		if !strings.HasPrefix(column.value, encryptedPrefix) {
+			return nil, errors.New("malformed encrypted token")
+		}
+
+		plaintext, err := open(key, strings.TrimPrefix(column.value, encryptedPrefix), column.aad)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt token: %w", err)
+		}
+		values = append(values, string(plaintext))
+	}
+
+	return values, nil
+}
+
+// seal a data key with a token key
+func wrapDataKey(key *TokenKey, dataKey []byte, aad string) (string, error) {
+
+	sealed, err := seal(key.key, dataKey, aad)
+	if err != nil {
+		return "", err
+	}
+	return encryptedPrefix + key.ID + ":" + sealed, nil
+}
+
+// open a data key sealed by wrapDataKey with whichever of the token keys sealed it
+func unwrapDataKey(keys *TokenKeys, wrapped string, aad string) ([]byte, error) {
+
+	if keys == nil {
+		return nil, ErrNoTokenKey
+	}
+
+	if !strings.HasPrefix(wrapped, encryptedPrefix) {
+		return nil, errors.New("malformed data key")
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(wrapped, encryptedPrefix), ":", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("malformed data key")
+	}
+
+	key, ok := keys.byID[parts[0]]
+	if !ok {
+		return nil, fmt.Errorf("data key sealed with unknown token key %s", parts[0])
+	}
+
+	dataKey, err := open(key.key, parts[1], aad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key: %w", err)
+	}
+	return dataKey, nil
+}
+
+// AES-GCM seal plaintext under key, returning the base64 nonce and ciphertext
+func seal(key []byte, plaintext []byte, aad string) (string, error) {
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	sealed := gcm.Seal(nonce, nonce, plaintext, []byte(aad))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open a value sealed by seal
+func open(key []byte, value string, aad string) ([]byte, error) {
+
+	sealed, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("malformed encrypted value: %w", err)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("malformed encrypted value")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+
+	return gcm.Open(nil, nonce, ciphertext, []byte(aad))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// the additional authenticated data binding a sealed value to its table, column and user
+func columnAAD(table string, column string, userID string) string {
+	return table + "." + column + ":" + userID
+}
+
+// TokenKeyFileRotate replaces the key in the key file at path, creating the file if there's none yet.  The
+// new key is written to path plus .new, every token row's data key is re-sealed with it in one transaction,
+// and then it replaces the key file.  A .new key left by an interrupted rotation may already seal data keys,
+// so the rotation is finished with that key rather than a new one.
+func TokenKeyFileRotate(ctx context.Context, db *sql.DB, path string) (*TokenKey, error) {
+
+	// with no key yet, every token is still plaintext
+	oldKeys, err := LoadTokenKeys(path)
+	if err != nil && err != ErrNoTokenKey {
+		return nil, err
+	}
+
+	newPath := path + pendingKeySuffix
+	created := false
+
+	newKey, err := readTokenKey(newPath)
+	if os.IsNotExist(err) {
+		newKey, err = GenerateTokenKey(newPath)
+		created = true
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !created {
+		log.Printf("Finishing the interrupted rotation to the key in %s", newPath)
+		if oldKeys == nil {
+			// the first key was interrupted on its way in
+			oldKeys = NewTokenKeys(newKey)
+		}
+	}
+
+	err = TokenKeyRotate(ctx, db, oldKeys, newKey)
+	if err != nil {
+		// a key this run didn't create may seal data keys already, so it's only removed if this run made it
+		if created {
+			os.Remove(newPath)
+		}
+		return nil, fmt.Errorf("failed to re-seal token data keys, the key is unchanged: %w", err)
+	}
+
+	err = os.Rename(newPath, path)
+	if err != nil {
+		return nil, fmt.Errorf("tokens are encrypted with the key in %s but it couldn't be moved to %s: %w",
+			newPath, path, err)
+	}
+
+	return newKey, nil
+}
+
+// TokenKeyRotate re-seals every token row's data key with newKey, in one transaction.  Existing data keys are
+// opened with oldKeys, which may be nil if no key was set up before; rows still in plaintext get a data key
+// and are encrypted.
+func TokenKeyRotate(ctx context.Context, db *sql.DB, oldKeys *TokenKeys, newKey *TokenKey) error {
+
+	newKeys := NewTokenKeys(newKey)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rewrapped := 0
+	encrypted := 0
+
+	for _, table := range tokenTables {
+
+		rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT id, userId, dataKey, %s FROM %s",
+			strings.Join(table.columns, ", "), table.name))
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", table.name, err)
+		}
+
+		tokenRows := make([]tokenRow, 0)
+		for rows.Next() {
+			row := tokenRow{values: make([]string, len(table.columns))}
+			dest := []interface{}{&row.id, &row.userID, &row.dataKey}
+			for i := range row.values {
+				dest = append(dest, &row.values[i])
+			}
+
+			err = rows.Scan(dest...)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan row: %w", err)
+			}
+			tokenRows = append(tokenRows, row)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		for _, row := range tokenRows {
+			dataKeyAAD := columnAAD(table.name, "dataKey", row.userID)
+
+			if row.dataKey.Valid {
+				// only the data key changes, the tokens stay sealed with it
+				dataKey, err := unwrapDataKey(oldKeys, row.dataKey.String, dataKeyAAD)
+				if err != nil {
+					return fmt.Errorf("%s data key for user %s: %w", table.name, row.userID, err)
+				}
+
+				wrapped, err := wrapDataKey(newKey, dataKey, dataKeyAAD)
+				if err != nil {
+					return err
+				}
+
+				_, err = tx.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET dataKey=? WHERE id=?", table.name),
+					wrapped, row.id)
+				if err != nil {
+					return fmt.Errorf("failed to update %s data key: %w", table.name, err)
+				}
+				rewrapped++
+				continue
+			}
+
+			columns := make([]tokenColumn, 0, len(table.columns))
+			for i, name := range table.columns {
+				columns = append(columns, tokenColumn{row.values[i], columnAAD(table.name, name, row.userID)})
+			}
+
+			dataKey, values, err := encryptTokens(newKeys, dataKeyAAD, columns...)
+			if err != nil {
+				return err
+			}
+
+			set := make([]string, 0, len(table.columns))
+			args := []interface{}{dataKey}
+			for i, name := range table.columns {
+				set = append(set, name+"=?")
+				args = append(args, values[i])
+			}
+			args = append(args, row.id)
+
+			_, err = tx.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET dataKey=?, %s WHERE id=?", table.name,
+				strings.Join(set, ", ")), args...)
+			if err != nil {
+				return fmt.Errorf("failed to encrypt %s: %w", table.name, err)
+			}
+			encrypted++
+		}
+	}
+
+	log.Printf("Re-sealed %d data keys and encrypted %d plaintext token rows with key %s",
+		rewrapped, encrypted, newKey.ID)
+
+	return tx.Commit()
+}
+
+// a table of tokens, whose columns are sealed with columnAAD
+type tokenTable struct {
+	name    string
+	columns []string
+}
+
+var tokenTables = []tokenTable{
+	{"withingsTokens", []string{"token"}},
+	{"fatsecretTokens", []string{"token", "secret"}},
+}
+
+type tokenRow struct {
+	id      int64
+	userID  string
+	dataKey sql.NullString
+	values  []string
+}
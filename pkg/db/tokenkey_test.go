@@ -0,0 +1,364 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func newTestTokenKey(t *testing.T) *TokenKey {
+	key, err := GenerateTokenKey(filepath.Join(t.TempDir(), "tokenKeyFile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// a migrated db with one user
+func newTokenDB(t *testing.T) (*sql.DB, User) {
+
+	db := openTestDB(t)
+	err := Migrate(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := User{UserID: "u1", UserName: "amy"}
+	execAll(t, db, `INSERT INTO users (userId, userName) VALUES ('u1', 'amy'), ('u2', 'bob')`)
+	return db, user
+}
+
+type tokenRowValues struct {
+	withingsToken   string
+	withingsDataKey sql.NullString
+	fatSecretToken  string
+	fatSecretSecret string
+	fatSecretKey    sql.NullString
+}
+
+func readTokenRows(t *testing.T, db *sql.DB, userID string) tokenRowValues {
+
+	var v tokenRowValues
+	err := db.QueryRow("SELECT token, dataKey FROM withingsTokens WHERE userId=?", userID).
+		Scan(&v.withingsToken, &v.withingsDataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.QueryRow("SELECT token, secret, dataKey FROM fatsecretTokens WHERE userId=?", userID).
+		Scan(&v.fatSecretToken, &v.fatSecretSecret, &v.fatSecretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func saveTokens(t *testing.T, db *sql.DB, keys *TokenKeys, user User) {
+
+	ctx := context.Background()
+	err := WithingsTokenSave(ctx, db, keys, user, &oauth2.Token{AccessToken: "access", RefreshToken: "refresh"})
+	if err != nil {
+		t.Fatalf("WithingsTokenSave: %s", err)
+	}
+	err = FatSecretTokenSave(ctx, db, keys, user, "token", "secret")
+	if err != nil {
+		t.Fatalf("FatSecretTokenSave: %s", err)
+	}
+}
+
+func checkTokens(t *testing.T, db *sql.DB, keys *TokenKeys, user User) {
+
+	ctx := context.Background()
+	withingsToken, err := WithingsTokenGet(ctx, db, keys, user)
+	if err != nil {
+		t.Fatalf("WithingsTokenGet: %s", err)
+	}
+	if withingsToken.AccessToken != "access" || withingsToken.RefreshToken != "refresh" {
+		t.Errorf("withings token %+v", withingsToken)
+	}
+
+	token, secret, err := FatSecretTokenGet(ctx, db, keys, user)
+	if err != nil {
+		t.Fatalf("FatSecretTokenGet: %s", err)
+	}
+	if token != "token" || secret != "secret" {
+		t.Errorf("fatsecret token %q secret %q", token, secret)
+	}
+
+	all, err := WithingsTokensGetAll(ctx, db, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all[0].Token.AccessToken != "access" {
+		t.Errorf("all withings tokens %+v", all)
+	}
+}
+
+func TestTokensEncrypted(t *testing.T) {
+
+	db, user := newTokenDB(t)
+	keys := NewTokenKeys(newTestTokenKey(t))
+
+	saveTokens(t, db, keys, user)
+	checkTokens(t, db, keys, user)
+
+	rows := readTokenRows(t, db, user.UserID)
+	if !rows.withingsDataKey.Valid || !rows.fatSecretKey.Valid {
+		t.Fatal("encrypted rows have no data key")
+	}
+	for _, value := range []string{rows.withingsToken, rows.fatSecretToken, rows.fatSecretSecret} {
+		if !strings.HasPrefix(value, encryptedPrefix) || strings.Contains(value, "access") ||
+			strings.Contains(value, "secret") {
+			t.Errorf("token saved as %q", value)
+		}
+	}
+	if rows.withingsDataKey.String == rows.fatSecretKey.String {
+		t.Error("rows share a data key")
+	}
+
+	_, _, err := FatSecretTokenGet(context.Background(), db, nil, user)
+	if !errors.Is(err, ErrNoTokenKey) {
+		t.Errorf("reading without keys: got %v, want %v", err, ErrNoTokenKey)
+	}
+}
+
+// without a token key, as before encryption was set up, tokens are kept in plaintext
+func TestTokensPlaintext(t *testing.T) {
+
+	db, user := newTokenDB(t)
+
+	saveTokens(t, db, nil, user)
+	checkTokens(t, db, nil, user)
+
+	rows := readTokenRows(t, db, user.UserID)
+	if rows.withingsDataKey.Valid || rows.fatSecretKey.Valid || rows.fatSecretToken != "token" {
+		t.Errorf("plaintext rows %+v", rows)
+	}
+
+	// plaintext rows are still read once a key is set up
+	checkTokens(t, db, NewTokenKeys(newTestTokenKey(t)), user)
+}
+
+func TestTokenKeyRotate(t *testing.T) {
+
+	ctx := context.Background()
+	db, user := newTokenDB(t)
+	saveTokens(t, db, nil, user)
+
+	// the first rotation encrypts plaintext rows
+	key1 := newTestTokenKey(t)
+	err := TokenKeyRotate(ctx, db, nil, key1)
+	if err != nil {
+		t.Fatalf("first rotation: %s", err)
+	}
+	checkTokens(t, db, NewTokenKeys(key1), user)
+	before := readTokenRows(t, db, user.UserID)
+	if !before.withingsDataKey.Valid || !strings.HasPrefix(before.fatSecretToken, encryptedPrefix) {
+		t.Fatalf("rows not encrypted by the first rotation: %+v", before)
+	}
+
+	// later rotations only re-seal the data keys
+	key2 := newTestTokenKey(t)
+	err = TokenKeyRotate(ctx, db, NewTokenKeys(key1), key2)
+	if err != nil {
+		t.Fatalf("second rotation: %s", err)
+	}
+	checkTokens(t, db, NewTokenKeys(key2), user)
+
+	after := readTokenRows(t, db, user.UserID)
+	if after.withingsToken != before.withingsToken || after.fatSecretToken != before.fatSecretToken ||
+		after.fatSecretSecret != before.fatSecretSecret {
+		t.Error("rotation re-encrypted the tokens instead of just their data keys")
+	}
+	if after.withingsDataKey == before.withingsDataKey || after.fatSecretKey == before.fatSecretKey {
+		t.Error("rotation didn't re-seal the data keys")
+	}
+
+	_, err = WithingsTokenGet(ctx, db, NewTokenKeys(key1), user)
+	if err == nil {
+		t.Error("the old key still opens the rotated data key")
+	}
+}
+
+// an encrypted row copied to another user doesn't decrypt
+func TestTokensBoundToUser(t *testing.T) {
+
+	ctx := context.Background()
+	db, user := newTokenDB(t)
+	keys := NewTokenKeys(newTestTokenKey(t))
+	saveTokens(t, db, keys, user)
+
+	execAll(t, db, `INSERT INTO fatsecretTokens (userId, token, secret, dataKey)
+		SELECT 'u2', token, secret, dataKey FROM fatsecretTokens WHERE userId = 'u1'`)
+
+	_, _, err := FatSecretTokenGet(ctx, db, keys, User{UserID: "u2"})
+	if err == nil {
+		t.Error("a token copied to another user decrypted")
+	}
+}
+
+func TestGenerateTokenKeyKeepsExisting(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "tokenKeyFile")
+	key, err := GenerateTokenKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = GenerateTokenKey(path)
+	if err == nil {
+		t.Fatal("generated a key over an existing one")
+	}
+
+	kept, err := readTokenKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kept.ID != key.ID {
+		t.Errorf("key file holds key %s, want %s", kept.ID, key.ID)
+	}
+
+	files, err := filepath.Glob(path + "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("key files %v, want just %s", files, path)
+	}
+}
+
+func TestTokenKeyFileRotate(t *testing.T) {
+
+	ctx := context.Background()
+	db, user := newTokenDB(t)
+	saveTokens(t, db, nil, user)
+	path := filepath.Join(t.TempDir(), "tokenKeyFile")
+
+	for i := 0; i < 2; i++ {
+		key, err := TokenKeyFileRotate(ctx, db, path)
+		if err != nil {
+			t.Fatalf("rotation %d: %s", i, err)
+		}
+
+		keys, err := LoadTokenKeys(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys.current.ID != key.ID || len(keys.byID) != 1 {
+			t.Errorf("rotation %d: loaded keys %v, want just %s", i, keys.byID, key.ID)
+		}
+		checkTokens(t, db, keys, user)
+	}
+}
+
+// a rotation interrupted after re-sealing the data keys is finished with the key it left, not a new one
+func TestTokenKeyFileRotateResumes(t *testing.T) {
+
+	ctx := context.Background()
+	db, user := newTokenDB(t)
+	path := filepath.Join(t.TempDir(), "tokenKeyFile")
+
+	_, err := TokenKeyFileRotate(ctx, db, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKeys, err := LoadTokenKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saveTokens(t, db, oldKeys, user)
+
+	// the data keys are sealed with the pending key, but it never replaced the key file
+	pending, err := GenerateTokenKey(path + pendingKeySuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = TokenKeyRotate(ctx, db, oldKeys, pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed attempt leaves the pending key alone
+	closedDB := openTestDB(t)
+	closedDB.Close()
+	_, err = TokenKeyFileRotate(ctx, closedDB, path)
+	if err == nil {
+		t.Fatal("rotated a closed db")
+	}
+	_, err = readTokenKey(path + pendingKeySuffix)
+	if err != nil {
+		t.Fatalf("failed rotation removed the pending key: %s", err)
+	}
+
+	key, err := TokenKeyFileRotate(ctx, db, path)
+	if err != nil {
+		t.Fatalf("resuming: %s", err)
+	}
+	if key.ID != pending.ID {
+		t.Errorf("rotated to key %s, want the pending key %s", key.ID, pending.ID)
+	}
+
+	keys, err := LoadTokenKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTokens(t, db, keys, user)
+}
+
+// the first start creates the token key and encrypts tokens older versions saved in plaintext
+func TestInitCreatesTokenKey(t *testing.T) {
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "wfsync.db")
+	keyPath := filepath.Join(dir, "tokenKeyFile")
+
+	db, user := newTokenDB(t)
+	saveTokens(t, db, nil, user)
+	execAll(t, db, `VACUUM INTO '`+dbPath+`'`)
+
+	initDB, keys, err := Init(ctx, dbPath, keyPath)
+	if err != nil {
+		t.Fatalf("Init: %s", err)
+	}
+	defer initDB.Close()
+
+	if keys == nil {
+		t.Fatal("no token keys")
+	}
+	checkTokens(t, initDB, keys, user)
+
+	rows := readTokenRows(t, initDB, user.UserID)
+	if !rows.withingsDataKey.Valid || !strings.HasPrefix(rows.fatSecretToken, encryptedPrefix) {
+		t.Errorf("plaintext tokens not encrypted: %+v", rows)
+	}
+
+	// later starts load the same key
+	_, again, err := Init(ctx, dbPath, keyPath)
+	if err != nil {
+		t.Fatalf("second Init: %s", err)
+	}
+	if again.current.ID != keys.current.ID {
+		t.Errorf("second start loaded key %s, want %s", again.current.ID, keys.current.ID)
+	}
+}
+
+func TestInitBadTokenKey(t *testing.T) {
+
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "tokenKeyFile")
+	err := ioutil.WriteFile(keyPath, []byte("short"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = Init(context.Background(), filepath.Join(dir, "wfsync.db"), keyPath)
+	if err == nil {
+		t.Error("started with a bad token key file")
+	}
+}
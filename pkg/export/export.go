@@ -0,0 +1,241 @@
+package export
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/bdelliott/wfsync/pkg/db"
+	"github.com/bdelliott/wfsync/pkg/fatsecret"
+)
+
+// Profile is the user's account information as exported.  OAuth tokens are left out: they are credentials
+// for the linked services, not data about the user.
+type Profile struct {
+	UserID          string            `json:"userId"`
+	UserName        string            `json:"userName"`
+	WithingsLinked  bool              `json:"withingsLinked"`
+	FatSecretLinked bool              `json:"fatsecretLinked"`
+	Settings        map[string]string `json:"settings"`
+	ExportedAt      time.Time         `json:"exportedAt"`
+}
+
+// Measurement is a measurement as exported.  Value is the measured value in the type's standard unit (kg
+// for masses, % for fat ratio, ...); RawValue and RawUnit are as saved from the source, Value = RawValue *
+// 10^RawUnit.
+type Measurement struct {
+	Time     time.Time `json:"time"`
+	Source   string    `json:"source"`
+	Type     string    `json:"type"`
+	TypeCode int       `json:"typeCode"`
+	Value    float64   `json:"value"`
+	RawValue int64     `json:"rawValue"`
+	RawUnit  int       `json:"rawUnit"`
+	GroupID  int64     `json:"groupId"`
+}
+
+// Sync is what wfsync keeps about the user's syncs: how far they got, and which weights went to FatSecret
+type Sync struct {
+	WithingsUpdatedTo *time.Time  `json:"withingsUpdatedTo"` // Withings changes up to here are synced
+	FatSecretSyncedAt *time.Time  `json:"fatsecretSyncedAt"` // last read of the FatSecret weight history
+	PushedWeighIns    []time.Time `json:"pushedWeighIns"`    // Withings weigh-ins pushed to FatSecret
+	DayPushes         []DayPush   `json:"dayPushes"`         // the weight last pushed for each day
+}
+
+// DayPush is the weight last pushed to FatSecret for a day
+type DayPush struct {
+	Date string  `json:"date"` // YYYY-MM-DD
+	Kg   float64 `json:"kg"`
+}
+
+var csvHeader = []string{"time", "source", "type", "typeCode", "value", "rawValue", "rawUnit", "groupId"}
+
+// Write writes a ZIP archive of everything saved for the user: profile.json, their measurement history as
+// both measurements.json and measurements.csv, and sync.json.
+func Write(ctx context.Context, sqlDB *sql.DB, user db.User, w io.Writer) error {
+
+	profile, err := getProfile(ctx, sqlDB, user)
+	if err != nil {
+		return err
+	}
+
+	measurements, err := db.MeasurementsGetAll(ctx, sqlDB, user.UserID)
+	if err != nil {
+		return err
+	}
+
+	exported := make([]Measurement, 0)
+	for _, m := range measurements {
+		exported = append(exported, Measurement{
+			Time:     time.Unix(m.Timestamp, 0).UTC(),
+			Source:   m.Source,
+			Type:     m.Type.String(),
+			TypeCode: int(m.Type),
+			Value:    m.Float(),
+			RawValue: m.Value,
+			RawUnit:  m.Unit,
+			GroupID:  m.GroupID,
+		})
+	}
+
+	sync, err := getSync(ctx, sqlDB, user.UserID)
+	if err != nil {
+		return err
+	}
+
+	archive := zip.NewWriter(w)
+
+	err = writeJSON(archive, "profile.json", profile)
+	if err != nil {
+		return err
+	}
+
+	err = writeJSON(archive, "measurements.json", exported)
+	if err != nil {
+		return err
+	}
+
+	err = writeCSV(archive, "measurements.csv", exported)
+	if err != nil {
+		return err
+	}
+
+	err = writeJSON(archive, "sync.json", sync)
+	if err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+func getProfile(ctx context.Context, sqlDB *sql.DB, user db.User) (*Profile, error) {
+
+	settings, err := db.UserSettingsGetAll(ctx, sqlDB, user.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	withingsLinked, err := db.WithingsTokenExists(ctx, sqlDB, user)
+	if err != nil {
+		return nil, err
+	}
+
+	fatSecretLinked, err := db.FatSecretTokenExists(ctx, sqlDB, user)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := &Profile{
+		UserID:          user.UserID,
+		UserName:        user.UserName,
+		WithingsLinked:  withingsLinked,
+		FatSecretLinked: fatSecretLinked,
+		Settings:        settings,
+		ExportedAt:      time.Now().UTC(),
+	}
+	return profile, nil
+}
+
+func getSync(ctx context.Context, sqlDB *sql.DB, userID string) (*Sync, error) {
+
+	sync := &Sync{
+		PushedWeighIns: make([]time.Time, 0),
+		DayPushes:      make([]DayPush, 0),
+	}
+
+	cursor, err := db.WithingsCursorGet(ctx, sqlDB, userID)
+	if err != nil && err != db.ErrNotFound {
+		return nil, err
+	}
+	if err == nil {
+		sync.WithingsUpdatedTo = unixTime(cursor.LastUpdate)
+	}
+
+	lastSync, err := db.FatSecretCursorGet(ctx, sqlDB, userID)
+	if err != nil && err != db.ErrNotFound {
+		return nil, err
+	}
+	if err == nil {
+		sync.FatSecretSyncedAt = unixTime(lastSync)
+	}
+
+	pushed, err := db.WeightsPushedGet(ctx, sqlDB, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, timestamp := range pushed {
+		sync.PushedWeighIns = append(sync.PushedWeighIns, *unixTime(timestamp))
+	}
+
+	dayPushes, err := db.FatSecretDayPushesGet(ctx, sqlDB, userID)
+	if err != nil {
+		return nil, err
+	}
+	for day, weight := range dayPushes {
+		sync.DayPushes = append(sync.DayPushes, DayPush{
+			Date: fatsecret.Date(day).Time().Format("2006-01-02"),
+			Kg:   weight.Kg(),
+		})
+	}
+	sort.Slice(sync.DayPushes, func(i, j int) bool { return sync.DayPushes[i].Date < sync.DayPushes[j].Date })
+
+	return sync, nil
+}
+
+func unixTime(timestamp int64) *time.Time {
+	t := time.Unix(timestamp, 0).UTC()
+	return &t
+}
+
+func writeJSON(archive *zip.Writer, name string, v interface{}) error {
+
+	f, err := archive.Create(name)
+	if err != nil {
+		return fmt.Errorf("failed to add %s to export: %w", name, err)
+	}
+
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func writeCSV(archive *zip.Writer, name string, measurements []Measurement) error {
+
+	f, err := archive.Create(name)
+	if err != nil {
+		return fmt.Errorf("failed to add %s to export: %w", name, err)
+	}
+
+	writer := csv.NewWriter(f)
+	err = writer.Write(csvHeader)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range measurements {
+		record := []string{
+			m.Time.Format(time.RFC3339),
+			m.Source,
+			m.Type,
+			strconv.Itoa(m.TypeCode),
+			strconv.FormatFloat(m.Value, 'f', -1, 64),
+			strconv.FormatInt(m.RawValue, 10),
+			strconv.Itoa(m.RawUnit),
+			strconv.FormatInt(m.GroupID, 10),
+		}
+		err = writer.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
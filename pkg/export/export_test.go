@@ -0,0 +1,220 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/bdelliott/wfsync/pkg/db"
+)
+
+// what the export holds from each table with a userId column.  Tokens are credentials, only whether they
+// exist is exported.
+var exportedTables = map[string]string{
+	"users":                "profile.json",
+	"userSettings":         "profile.json",
+	"withingsTokens":       "profile.json",
+	"fatsecretTokens":      "profile.json",
+	"oauthRequestTokens":   "",
+	"measurements":         "measurements.json",
+	"withingsSyncCursors":  "sync.json",
+	"fatsecretSyncCursors": "sync.json",
+	"fatsecretPushes":      "sync.json",
+	"fatsecretDayPushes":   "sync.json",
+}
+
+// save a row for the user in every table, with values offset by n so each user's are distinct
+func saveUserData(t *testing.T, sqlDB *sql.DB, user db.User, n int64) {
+	t.Helper()
+	ctx := context.Background()
+
+	for _, err := range []error{
+		db.UserCreate(ctx, sqlDB, user),
+		db.UserSettingSave(ctx, sqlDB, user.UserID, "syncInterval", user.UserName+" interval"),
+		db.MeasurementsSync(ctx, sqlDB, user.UserID, []db.Measurement{
+			{Source: db.SourceWithings, GroupID: n, Type: db.MeasureWeight, Value: 80000 + n, Unit: -3,
+				Timestamp: 1500000000 + n},
+		}),
+		db.WithingsCursorSave(ctx, sqlDB, user.UserID, db.WithingsCursor{LastUpdate: 1510000000 + n}),
+		db.FatSecretCursorSave(ctx, sqlDB, user.UserID, 1520000000+n),
+		db.WeightPushedSave(ctx, sqlDB, user.UserID, db.Weight{Timestamp: 1500000000 + n}),
+		db.FatSecretDayPushSave(ctx, sqlDB, user.UserID, 17000+n, db.Weight{Value: 80000 + n, Unit: -3}),
+		db.WithingsTokenSave(ctx, sqlDB, nil, user, &oauth2.Token{AccessToken: user.UserName + " access token"}),
+		db.FatSecretTokenSave(ctx, sqlDB, nil, user, user.UserName+" fatsecret token",
+			user.UserName+" fatsecret secret"),
+		db.OAuthRequestTokenSave(ctx, sqlDB, user.UserID, "fatsecret", user.UserName+" request token",
+			user.UserName+" request secret", time.Now().Add(time.Hour)),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// the tables with a userId column
+func userTables(t *testing.T, sqlDB *sql.DB) []string {
+	t.Helper()
+
+	rows, err := sqlDB.Query(`SELECT m.name FROM sqlite_master m, pragma_table_info(m.name) c
+		WHERE m.type = 'table' AND c.name = 'userId'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	tables := make([]string, 0)
+	for rows.Next() {
+		var table string
+		err = rows.Scan(&table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, table)
+	}
+	if rows.Err() != nil {
+		t.Fatal(rows.Err())
+	}
+	return tables
+}
+
+func readArchive(t *testing.T, data []byte) map[string][]byte {
+	t.Helper()
+
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string][]byte)
+	for _, f := range archive.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name], err = ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return files
+}
+
+func decode(t *testing.T, files map[string][]byte, name string, v interface{}) {
+	t.Helper()
+
+	err := json.Unmarshal(files[name], v)
+	if err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+}
+
+// the export holds every table's rows for the user, and nothing of anyone else's
+func TestWrite(t *testing.T) {
+
+	ctx := context.Background()
+	sqlDB, err := db.Open(filepath.Join(t.TempDir(), "wfsync.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlDB.Close()
+	err = db.Migrate(ctx, sqlDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range userTables(t, sqlDB) {
+		_, ok := exportedTables[table]
+		if !ok {
+			t.Errorf("table %s holds user data: add it to the export, and to exportedTables", table)
+		}
+	}
+
+	amy := db.User{UserID: "u1", UserName: "amy", PasswordHash: "amy hash"}
+	bob := db.User{UserID: "u2", UserName: "bob", PasswordHash: "bob hash"}
+	saveUserData(t, sqlDB, amy, 1)
+	saveUserData(t, sqlDB, bob, 2)
+
+	var buf bytes.Buffer
+	err = Write(ctx, sqlDB, amy, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := readArchive(t, buf.Bytes())
+
+	for _, name := range []string{"profile.json", "measurements.json", "measurements.csv", "sync.json"} {
+		_, ok := files[name]
+		if !ok {
+			t.Errorf("no %s in the export", name)
+		}
+	}
+
+	var profile Profile
+	decode(t, files, "profile.json", &profile)
+	profile.ExportedAt = time.Time{}
+	wantProfile := Profile{
+		UserID:          "u1",
+		UserName:        "amy",
+		WithingsLinked:  true,
+		FatSecretLinked: true,
+		Settings:        map[string]string{"syncInterval": "amy interval"},
+	}
+	if !reflect.DeepEqual(profile, wantProfile) {
+		t.Errorf("profile: got %+v, want %+v", profile, wantProfile)
+	}
+
+	var measurements []Measurement
+	decode(t, files, "measurements.json", &measurements)
+	wantMeasurements := []Measurement{{
+		Time:     time.Unix(1500000001, 0).UTC(),
+		Source:   db.SourceWithings,
+		Type:     "weight",
+		TypeCode: int(db.MeasureWeight),
+		Value:    80.001,
+		RawValue: 80001,
+		RawUnit:  -3,
+		GroupID:  1,
+	}}
+	if !reflect.DeepEqual(measurements, wantMeasurements) {
+		t.Errorf("measurements: got %+v, want %+v", measurements, wantMeasurements)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(files["measurements.csv"])), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], "2017-07-14T02:40:01Z,withings,weight,1,80.001,") {
+		t.Errorf("measurements.csv: got %q", lines)
+	}
+
+	var sync Sync
+	decode(t, files, "sync.json", &sync)
+	withingsUpdatedTo := time.Unix(1510000001, 0).UTC()
+	fatSecretSyncedAt := time.Unix(1520000001, 0).UTC()
+	wantSync := Sync{
+		WithingsUpdatedTo: &withingsUpdatedTo,
+		FatSecretSyncedAt: &fatSecretSyncedAt,
+		PushedWeighIns:    []time.Time{time.Unix(1500000001, 0).UTC()},
+		DayPushes:         []DayPush{{Date: "2016-07-19", Kg: 80.001}},
+	}
+	if !reflect.DeepEqual(sync, wantSync) {
+		t.Errorf("sync: got %+v, want %+v", sync, wantSync)
+	}
+
+	// nothing of bob's, and no credentials
+	for name, data := range files {
+		for _, leak := range []string{"u2", "bob", "80.002", "80002", "hash", "access token", "fatsecret token",
+			"fatsecret secret", "request token", "request secret"} {
+			if bytes.Contains(data, []byte(leak)) {
+				t.Errorf("%s contains %q:\n%s", name, leak, data)
+			}
+		}
+	}
+}
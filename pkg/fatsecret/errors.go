@@ -0,0 +1,64 @@
+package fatsecret
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sentinel errors for the FatSecret error codes callers act on.  Match them with errors.Is; the *Error
+// returned by the client keeps the original code and message.
+var (
+	ErrUnknown          = errors.New("fatsecret: unknown error")
+	ErrInvalidConsumer  = errors.New("fatsecret: invalid consumer key")
+	ErrInvalidTimestamp = errors.New("fatsecret: invalid or expired timestamp")
+	ErrInvalidNonce     = errors.New("fatsecret: invalid or used nonce")
+	ErrInvalidSignature = errors.New("fatsecret: invalid signature")
+	ErrInvalidToken     = errors.New("fatsecret: invalid access token")
+	ErrRateLimit        = errors.New("fatsecret: too many requests")
+	ErrMissingParameter = errors.New("fatsecret: missing required parameter")
+	ErrInvalidValue     = errors.New("fatsecret: invalid parameter value")
+	ErrInvalidDate      = errors.New("fatsecret: invalid date")
+	ErrWeightDateLate   = errors.New("fatsecret: weight date is too far in the future")
+	ErrWeightDateEarly  = errors.New("fatsecret: weight date is earlier than the latest weight")
+	ErrNoEntries        = errors.New("fatsecret: no entries found")
+)
+
+// https://platform.fatsecret.com/api/Default.aspx?screen=rapiec
+var errorCodes = map[int]error{
+	1:   ErrUnknown,
+	5:   ErrInvalidConsumer,
+	6:   ErrInvalidTimestamp,
+	7:   ErrInvalidNonce,
+	8:   ErrInvalidSignature,
+	9:   ErrInvalidToken,
+	12:  ErrRateLimit,
+	13:  ErrInvalidToken,
+	101: ErrMissingParameter,
+	106: ErrInvalidValue,
+	107: ErrInvalidValue,
+	108: ErrInvalidDate,
+	205: ErrWeightDateLate,
+	206: ErrWeightDateEarly,
+	207: ErrNoEntries,
+}
+
+// Error is an error returned by the FatSecret API
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("FatSecret error %d: %s", e.Code, e.Message)
+}
+
+// Is matches the sentinel error for the code, if there is one
+func (e *Error) Is(target error) bool {
+	sentinel, ok := errorCodes[e.Code]
+	return ok && sentinel == target
+}
+
+// error envelope returned by the API in place of a normal response
+type errorResponse struct {
+	Error *Error `json:"error"`
+}
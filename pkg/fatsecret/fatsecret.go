@@ -1,27 +1,41 @@
 package fatsecret
 
 import (
-	"github.com/bdelliott/wfsync/pkg/oauth1"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/bdelliott/wfsync/pkg/oauth1"
 )
 
+const daySeconds = 60 * 60 * 24
+
+// Weight types FatSecret can display a user's weight in
+const (
+	WeightTypeKg = "kg"
+	WeightTypeLb = "lb"
+)
 
 // FatSecret API client
 type Client struct {
 	OAuthClient oauth1.Client
 }
 
-func NewClient() Client {
+// NewClient returns a client for the app itself, as used to link a user's account
+func NewClient(s *State) Client {
 	provider := oauth1.Provider{
 		RequestTokenURL: "http://www.fatsecret.com/oauth/request_token",
 		AuthorizeURL: "http://www.fatsecret.com/oauth/authorize",
 		AccessTokenURL: "http://www.fatsecret.com/oauth/access_token",
 		RequestURL: "http://platform.fatsecret.com/rest/server.api",
 	}
-	credentials := oauth1.CredentialsFromEnv("fatsecret")
 
 	oauthClient := oauth1.Client{
-		Credentials: credentials,
+		Credentials: s.Credentials,
 		Provider: provider,
 	}
 
@@ -30,12 +44,101 @@ func NewClient() Client {
 	}
 }
 
+// NewUserClient returns a client making requests on behalf of a user with previously saved credentials
+func NewUserClient(s *State, token string, secret string) Client {
+	client := NewClient(s)
+	client.OAuthClient.Token = token
+	client.OAuthClient.Secret = secret
+	return client
+}
 
-func (c Client) WeightsGetMonth() string {
+// WeightsGetMonth retrieves the user's weights for the month containing date
+func (c Client) WeightsGetMonth(ctx context.Context, date time.Time) (*WeightMonth, error) {
 
 	params := url.Values{}
 	params.Add("method", "weights.get_month")
 	params.Add("format", "json")
+	params.Add("date", strconv.FormatInt(dateInt(date), 10))
+
+	var resp weightsGetMonthResponse
+	err := c.call(ctx, params, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &resp.Month, nil
+}
+
+// WeightUpdate records the user's weight (in kg) for the day of the given date.  FatSecret keeps a single
+// weight per day, so a later update for the same day replaces the earlier one.  weightType sets the unit
+// FatSecret displays the user's weights in; pass their profile's WeightType to leave it as it is.
+func (c Client) WeightUpdate(ctx context.Context, weightKg float64, date time.Time, weightType string) error {
+
+	params := url.Values{}
+	params.Add("method", "weight.update")
+	params.Add("format", "json")
+	params.Add("current_weight_kg", strconv.FormatFloat(weightKg, 'f', 2, 64))
+	params.Add("date", strconv.FormatInt(dateInt(date), 10))
+	params.Add("weight_type", weightType)
+
+	var resp successResponse
+	err := c.call(ctx, params, &resp)
+	if err != nil {
+		return err
+	}
+
+	if resp.Success == nil {
+		return errors.New("FatSecret weight.update response has no success value")
+	}
+	return nil
+}
+
+// ProfileGet retrieves the user's profile
+func (c Client) ProfileGet(ctx context.Context) (*Profile, error) {
+
+	params := url.Values{}
+	params.Add("method", "profile.get")
+	params.Add("format", "json")
+
+	var resp profileGetResponse
+	err := c.call(ctx, params, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &resp.Profile, nil
+}
+
+// make an API call, decoding the response into result.  An error envelope is returned as an *Error.
+func (c Client) call(ctx context.Context, params url.Values, result interface{}) error {
+
+	resp, err := c.OAuthClient.Request(ctx, params)
+	if err != nil {
+		return fmt.Errorf("FatSecret %s request failed: %w", params.Get("method"), err)
+	}
+	body := []byte(resp)
+
+	var errResp errorResponse
+	err = json.Unmarshal(body, &errResp)
+	if err != nil {
+		return fmt.Errorf("failed to parse FatSecret response %q: %w", body, err)
+	}
+
+	if errResp.Error != nil {
+		return errResp.Error
+	}
+
+	err = json.Unmarshal(body, result)
+	if err != nil {
+		return fmt.Errorf("failed to decode FatSecret %s response: %w", params.Get("method"), err)
+	}
+
+	return nil
+}
 
-	return c.OAuthClient.Request(params)
+// FatSecret identifies days by the number of days since Jan 1, 1970.  The day is date's calendar day in its
+// own location, so a time in the user's time zone gives the user's day.
+func dateInt(date time.Time) int64 {
+	year, month, day := date.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Unix() / daySeconds
 }
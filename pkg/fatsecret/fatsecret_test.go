@@ -0,0 +1,138 @@
+package fatsecret
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// a user client talking to a local stand-in for the FatSecret API
+func newTestClient(t *testing.T, handler http.HandlerFunc) Client {
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	client := NewUserClient(StateInit("key", "secret", "http://wfsync.example/callback"), "token", "token secret")
+	client.OAuthClient.Provider.RequestURL = server.URL + "/rest/server.api"
+	client.OAuthClient.Now = func() time.Time { return time.Unix(1697800000, 0) }
+	client.OAuthClient.Nonce = func() (string, error) { return "nonce", nil }
+	return client
+}
+
+// checks the request is a signed call of method, with the client's fixed clock and nonce
+func checkCall(t *testing.T, req *http.Request, method string) {
+
+	query := req.URL.Query()
+	if query.Get("method") != method || query.Get("format") != "json" {
+		t.Errorf("got method %q format %q, want %s as json", query.Get("method"), query.Get("format"), method)
+	}
+	if query.Get("oauth_token") != "token" || query.Get("oauth_signature") == "" {
+		t.Errorf("request isn't signed with the user's token: %v", query)
+	}
+	if query.Get("oauth_timestamp") != "1697800000" || query.Get("oauth_nonce") != "nonce" {
+		t.Errorf("request doesn't use the client's clock and nonce: %v", query)
+	}
+}
+
+func TestWeightsGetMonth(t *testing.T) {
+
+	client := newTestClient(t, func(rw http.ResponseWriter, req *http.Request) {
+		checkCall(t, req, "weights.get_month")
+		if req.URL.Query().Get("date") != "19650" {
+			t.Errorf("date %q, want 19650", req.URL.Query().Get("date"))
+		}
+		// a single day comes as an object, numbers as strings
+		rw.Write([]byte(`{"month": {"from_date_int": "19631", "to_date_int": "19660",
+			"day": {"date_int": "19650", "weight_kg": "80.5", "weight_comment": "after run"}}}`))
+	})
+
+	month, err := client.WeightsGetMonth(context.Background(), Date(19650).Time())
+	if err != nil {
+		t.Fatalf("WeightsGetMonth: %s", err)
+	}
+
+	want := WeightDays{{Date: 19650, WeightKg: 80.5, Comment: "after run"}}
+	if month.FromDate != 19631 || month.ToDate != 19660 || len(month.Days) != 1 || month.Days[0] != want[0] {
+		t.Errorf("got %+v, want days %+v", month, want)
+	}
+}
+
+func TestWeightUpdate(t *testing.T) {
+
+	client := newTestClient(t, func(rw http.ResponseWriter, req *http.Request) {
+		checkCall(t, req, "weight.update")
+		query := req.URL.Query()
+		if query.Get("current_weight_kg") != "80.50" || query.Get("date") != "19650" ||
+			query.Get("weight_type") != WeightTypeLb {
+			t.Errorf("bad weight.update parameters: %v", query)
+		}
+		rw.Write([]byte(`{"success": {"value": "1"}}`))
+	})
+
+	err := client.WeightUpdate(context.Background(), 80.5, Date(19650).Time(), WeightTypeLb)
+	if err != nil {
+		t.Errorf("WeightUpdate: %s", err)
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+
+	client := newTestClient(t, func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(`{"error": {"code": 206, "message": "Weight date is earlier than the last weight"}}`))
+	})
+
+	err := client.WeightUpdate(context.Background(), 80.5, Date(19650).Time(), WeightTypeKg)
+	if !errors.Is(err, ErrWeightDateEarly) {
+		t.Errorf("got %v, want %v", err, ErrWeightDateEarly)
+	}
+
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Code != 206 {
+		t.Errorf("got %v, want an *Error with code 206", err)
+	}
+}
+
+func TestCancel(t *testing.T) {
+
+	started := make(chan struct{})
+	client := newTestClient(t, func(rw http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-req.Context().Done()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	_, err := client.ProfileGet(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestProfileWeightType(t *testing.T) {
+
+	tests := []struct {
+		weightMeasure string
+		want          string
+	}{
+		{"Kg", WeightTypeKg},
+		{"Lb", WeightTypeLb},
+		{"lb", WeightTypeLb},
+		{"", WeightTypeKg},
+		{"St", WeightTypeKg},
+	}
+
+	for _, tt := range tests {
+		profile := Profile{WeightMeasure: tt.weightMeasure}
+		got := profile.WeightType()
+		if got != tt.want {
+			t.Errorf("weight measure %q: weight type %q, want %q", tt.weightMeasure, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package fatsecret
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The JSON API sends most numbers as strings, and a list with a single element as just that element.
+
+// WeightMonth is the response to weights.get_month
+type WeightMonth struct {
+	FromDate Date       `json:"from_date_int"`
+	ToDate   Date       `json:"to_date_int"`
+	Days     WeightDays `json:"day"` // only days with a weight recorded
+}
+
+// WeightDay is the weight recorded on a day
+type WeightDay struct {
+	Date     Date   `json:"date_int"`
+	WeightKg Float  `json:"weight_kg"`
+	Comment  string `json:"weight_comment"`
+}
+
+// WeightDays is a list of days, decoded from an array or, for a single day, an object
+type WeightDays []WeightDay
+
+// Profile is the response to profile.get
+type Profile struct {
+	WeightMeasure     string `json:"weight_measure"` // "Kg" or "Lb"
+	HeightMeasure     string `json:"height_measure"` // "Cm" or "Inch"
+	LastWeightKg      Float  `json:"last_weight_kg"`
+	LastWeightDate    Date   `json:"last_weight_date_int"`
+	LastWeightComment string `json:"last_weight_comment"`
+	GoalWeightKg      Float  `json:"goal_weight_kg"`
+	HeightCm          Float  `json:"height_cm"`
+}
+
+// WeightType is the weight type matching the unit the profile displays weights in, kg if it's not one
+// FatSecret documents
+func (p *Profile) WeightType() string {
+	if strings.EqualFold(p.WeightMeasure, WeightTypeLb) {
+		return WeightTypeLb
+	}
+	return WeightTypeKg
+}
+
+type weightsGetMonthResponse struct {
+	Month WeightMonth `json:"month"`
+}
+
+type profileGetResponse struct {
+	Profile Profile `json:"profile"`
+}
+
+// response to update methods like weight.update
+type successResponse struct {
+	Success *struct {
+		Value string `json:"value"`
+	} `json:"success"`
+}
+
+// Float is a number sent as either a JSON string or number
+type Float float64
+
+// UnmarshalJSON accepts "80.5" as well as 80.5
+func (f *Float) UnmarshalJSON(data []byte) error {
+	s, err := unquote(data)
+	if err != nil || s == "" {
+		return err
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("bad number %s: %w", data, err)
+	}
+	*f = Float(v)
+	return nil
+}
+
+// Date is a day, counted in days since Jan 1, 1970
+type Date int64
+
+// UnmarshalJSON accepts "17410" as well as 17410
+func (d *Date) UnmarshalJSON(data []byte) error {
+	s, err := unquote(data)
+	if err != nil || s == "" {
+		return err
+	}
+
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad date %s: %w", data, err)
+	}
+	*d = Date(v)
+	return nil
+}
+
+// DateOf returns the day a time falls on in its location, as FatSecret counts days
+func DateOf(t time.Time) Date {
+	return Date(dateInt(t))
+}
+
+// Time returns midnight UTC at the start of the day
+func (d Date) Time() time.Time {
+	return time.Unix(int64(d)*daySeconds, 0).UTC()
+}
+
+// UnmarshalJSON accepts a single day as well as an array of them
+func (w *WeightDays) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '{' {
+		var day WeightDay
+		err := json.Unmarshal(data, &day)
+		if err != nil {
+			return err
+		}
+		*w = WeightDays{day}
+		return nil
+	}
+
+	var days []WeightDay
+	err := json.Unmarshal(data, &days)
+	if err != nil {
+		return err
+	}
+	*w = days
+	return nil
+}
+
+// the text of a JSON string or number, empty for null
+func unquote(data []byte) (string, error) {
+	if string(data) == "null" {
+		return "", nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		err := json.Unmarshal(data, &s)
+		return s, err
+	}
+	return string(data), nil
+}
@@ -1,13 +1,17 @@
 package fatsecret
 
+import "github.com/bdelliott/wfsync/pkg/oauth1"
+
 // State holds state related to FatSecret API
 type State struct {
 	AuthCallbackURL string
+	Credentials     oauth1.Credentials // the app's consumer key and secret
 }
 
-func StateInit(authCallbackURL string) *State {
+func StateInit(consumerKey string, consumerSecret string, authCallbackURL string) *State {
 
 	return &State{
 		AuthCallbackURL: authCallbackURL,
+		Credentials:     oauth1.NewCredentials(consumerKey, consumerSecret),
 	}
 }
@@ -0,0 +1,104 @@
+package oauth1
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Errors completing a flow, for callbacks that can't be matched with an authorization the user began.  The
+// user should start over.
+var (
+	ErrNoTemporaryCredentials = errors.New("no authorization in progress")
+	ErrExpired                = errors.New("authorization expired")
+	ErrTokenMismatch          = errors.New("callback token doesn't match the authorization in progress")
+	ErrMissingVerifier        = errors.New("callback has no verifier, authorization may have been denied")
+)
+
+// DefaultTTL is how long a user has to authorize the app when a flow doesn't set its own TTL
+const DefaultTTL = 15 * time.Minute
+
+// Flow runs the server side of three-legged authorization (RFC 5849 section 2): Begin gets temporary
+// credentials and sends the user to the provider, Complete handles the provider's callback and exchanges them
+// for token credentials.
+type Flow struct {
+	Client      Client
+	CallbackURL string         // where the provider sends the user back to, routed to a handler calling Complete
+	Store       TemporaryStore // keeps the temporary credentials until the callback
+	TTL         time.Duration  // how long the user has to authorize, DefaultTTL if zero
+}
+
+// Begin gets temporary credentials for a user and returns the URL to send them to for authorization
+func (f Flow) Begin(rw http.ResponseWriter, req *http.Request) (string, error) {
+
+	token, secret, err := f.Client.GetRequestToken(req.Context(), f.CallbackURL)
+	if err != nil {
+		return "", err
+	}
+
+	authorizeURL, err := f.Client.GetAuthorizeURL(token)
+	if err != nil {
+		return "", err
+	}
+
+	ttl := f.TTL
+	if ttl == 0 {
+		ttl = DefaultTTL
+	}
+
+	creds := TemporaryCredentials{
+		Token:   token,
+		Secret:  secret,
+		Expires: f.Client.now().Add(ttl),
+	}
+	err = f.Store.Save(rw, req, creds)
+	if err != nil {
+		return "", fmt.Errorf("failed to save temporary credentials: %w", err)
+	}
+
+	return authorizeURL, nil
+}
+
+// Complete verifies the provider's callback against the authorization the user began, and returns the token
+// credentials to make requests on their behalf.  The temporary credentials can only be used once: they are
+// deleted once a callback carries their token, or once they expire.  A callback with some other token leaves
+// them alone, so a forged or stale callback can't cancel the authorization in progress.
+func (f Flow) Complete(rw http.ResponseWriter, req *http.Request) (token string, secret string, err error) {
+
+	err = req.ParseForm()
+	if err != nil {
+		return "", "", fmt.Errorf("bad callback: %w", err)
+	}
+
+	creds, err := f.Store.Get(req)
+	if err != nil {
+		return "", "", err
+	}
+
+	if !f.Client.now().Before(creds.Expires) {
+		err = f.Store.Delete(rw, req)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to delete temporary credentials: %w", err)
+		}
+		return "", "", ErrExpired
+	}
+
+	callbackToken := req.Form.Get("oauth_token")
+	if subtle.ConstantTimeCompare([]byte(callbackToken), []byte(creds.Token)) != 1 {
+		return "", "", ErrTokenMismatch
+	}
+
+	err = f.Store.Delete(rw, req)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to delete temporary credentials: %w", err)
+	}
+
+	verifier := req.Form.Get("oauth_verifier")
+	if verifier == "" {
+		return "", "", ErrMissingVerifier
+	}
+
+	return f.Client.GetAccessToken(req.Context(), creds.Token, creds.Secret, verifier)
+}
@@ -0,0 +1,229 @@
+package oauth1
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// a provider handing out one request token, and access tokens for it with the verifier "verifier"
+func newFlowProvider(t *testing.T) *httptest.Server {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/request", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("oauth_callback_confirmed=true&oauth_token=reqtoken&oauth_token_secret=reqsecret"))
+	})
+	mux.HandleFunc("/access", func(rw http.ResponseWriter, req *http.Request) {
+		if req.FormValue("oauth_token") != "reqtoken" || req.FormValue("oauth_verifier") != "verifier" {
+			http.Error(rw, "bad token or verifier", http.StatusUnauthorized)
+			return
+		}
+		rw.Write([]byte("oauth_token=access&oauth_token_secret=accesssecret"))
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// a browser going through a flow, keeping the cookies it's given
+type flowBrowser struct {
+	flow    *Flow
+	cookies map[string]*http.Cookie
+	clock   time.Time
+}
+
+func newFlowBrowser(t *testing.T, store TemporaryStore) *flowBrowser {
+
+	server := newFlowProvider(t)
+
+	b := &flowBrowser{
+		cookies: make(map[string]*http.Cookie),
+		clock:   time.Unix(1700000000, 0),
+	}
+	b.flow = &Flow{
+		Client: Client{
+			Credentials: NewCredentials("key", "secret"),
+			Provider: Provider{
+				RequestTokenURL: server.URL + "/request",
+				AuthorizeURL:    server.URL + "/authorize",
+				AccessTokenURL:  server.URL + "/access",
+			},
+			Now: func() time.Time { return b.clock },
+		},
+		CallbackURL: "http://wfsync.example/callback",
+		Store:       store,
+	}
+	return b
+}
+
+func (b *flowBrowser) request(target string) (*httptest.ResponseRecorder, *http.Request) {
+
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for _, cookie := range b.cookies {
+		req.AddCookie(cookie)
+	}
+	return httptest.NewRecorder(), req
+}
+
+func (b *flowBrowser) keepCookies(rw *httptest.ResponseRecorder) {
+	for _, cookie := range rw.Result().Cookies() {
+		b.cookies[cookie.Name] = cookie
+	}
+}
+
+func (b *flowBrowser) begin(t *testing.T) {
+
+	rw, req := b.request("/begin")
+	authorizeURL, err := b.flow.Begin(rw, req)
+	if err != nil {
+		t.Fatalf("Begin: %s", err)
+	}
+	b.keepCookies(rw)
+
+	u, err := url.Parse(authorizeURL)
+	if err != nil {
+		t.Fatalf("bad authorize URL %q: %s", authorizeURL, err)
+	}
+	if u.Query().Get("oauth_token") != "reqtoken" {
+		t.Fatalf("authorize URL %q doesn't carry the request token", authorizeURL)
+	}
+}
+
+func (b *flowBrowser) callback(query url.Values) (string, string, error) {
+
+	rw, req := b.request("/callback?" + query.Encode())
+	token, secret, err := b.flow.Complete(rw, req)
+	b.keepCookies(rw)
+	return token, secret, err
+}
+
+var goodCallback = url.Values{"oauth_token": {"reqtoken"}, "oauth_verifier": {"verifier"}}
+
+func flowStores() map[string]func() TemporaryStore {
+	return map[string]func() TemporaryStore{
+		"memory": func() TemporaryStore {
+			return &MemoryStore{Key: func(req *http.Request) (string, error) { return "amy", nil }}
+		},
+		"session": func() TemporaryStore {
+			store := sessions.NewCookieStore(securecookie.GenerateRandomKey(32))
+			return SessionStore{Store: store, SessionName: "test", Prefix: "oauth1_"}
+		},
+	}
+}
+
+func TestFlow(t *testing.T) {
+
+	for name, newStore := range flowStores() {
+		t.Run(name, func(t *testing.T) {
+
+			t.Run("happy path", func(t *testing.T) {
+				b := newFlowBrowser(t, newStore())
+				b.begin(t)
+
+				token, secret, err := b.callback(goodCallback)
+				if err != nil {
+					t.Fatalf("Complete: %s", err)
+				}
+				if token != "access" || secret != "accesssecret" {
+					t.Errorf("got token %q secret %q, want access/accesssecret", token, secret)
+				}
+			})
+
+			t.Run("replay", func(t *testing.T) {
+				b := newFlowBrowser(t, newStore())
+				b.begin(t)
+
+				_, _, err := b.callback(goodCallback)
+				if err != nil {
+					t.Fatalf("Complete: %s", err)
+				}
+				_, _, err = b.callback(goodCallback)
+				if !errors.Is(err, ErrNoTemporaryCredentials) {
+					t.Errorf("replayed callback: got %v, want %v", err, ErrNoTemporaryCredentials)
+				}
+			})
+
+			t.Run("mismatch keeps the authorization", func(t *testing.T) {
+				b := newFlowBrowser(t, newStore())
+				b.begin(t)
+
+				_, _, err := b.callback(url.Values{"oauth_token": {"forged"}, "oauth_verifier": {"verifier"}})
+				if !errors.Is(err, ErrTokenMismatch) {
+					t.Errorf("forged callback: got %v, want %v", err, ErrTokenMismatch)
+				}
+
+				_, _, err = b.callback(goodCallback)
+				if err != nil {
+					t.Errorf("callback after a forged one: %s", err)
+				}
+			})
+
+			t.Run("missing verifier", func(t *testing.T) {
+				b := newFlowBrowser(t, newStore())
+				b.begin(t)
+
+				_, _, err := b.callback(url.Values{"oauth_token": {"reqtoken"}})
+				if !errors.Is(err, ErrMissingVerifier) {
+					t.Errorf("callback without verifier: got %v, want %v", err, ErrMissingVerifier)
+				}
+
+				_, _, err = b.callback(goodCallback)
+				if !errors.Is(err, ErrNoTemporaryCredentials) {
+					t.Errorf("callback after a denial: got %v, want %v", err, ErrNoTemporaryCredentials)
+				}
+			})
+
+			t.Run("expiry", func(t *testing.T) {
+				b := newFlowBrowser(t, newStore())
+				b.begin(t)
+				b.clock = b.clock.Add(DefaultTTL)
+
+				_, _, err := b.callback(goodCallback)
+				if !errors.Is(err, ErrExpired) {
+					t.Errorf("late callback: got %v, want %v", err, ErrExpired)
+				}
+
+				_, _, err = b.callback(goodCallback)
+				if !errors.Is(err, ErrNoTemporaryCredentials) {
+					t.Errorf("callback after expiry: got %v, want %v", err, ErrNoTemporaryCredentials)
+				}
+			})
+
+			t.Run("no authorization", func(t *testing.T) {
+				b := newFlowBrowser(t, newStore())
+
+				_, _, err := b.callback(goodCallback)
+				if !errors.Is(err, ErrNoTemporaryCredentials) {
+					t.Errorf("unexpected callback: got %v, want %v", err, ErrNoTemporaryCredentials)
+				}
+			})
+		})
+	}
+}
+
+func TestMemoryStoreWithoutKey(t *testing.T) {
+
+	store := &MemoryStore{}
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	err := store.Save(rw, req, TemporaryCredentials{Token: "t", Secret: "s", Expires: time.Now().Add(time.Minute)})
+	if !errors.Is(err, ErrNoKeyFunc) {
+		t.Errorf("Save: got %v, want %v", err, ErrNoKeyFunc)
+	}
+	_, err = store.Get(req)
+	if !errors.Is(err, ErrNoKeyFunc) {
+		t.Errorf("Get: got %v, want %v", err, ErrNoKeyFunc)
+	}
+	err = store.Delete(rw, req)
+	if !errors.Is(err, ErrNoKeyFunc) {
+		t.Errorf("Delete: got %v, want %v", err, ErrNoKeyFunc)
+	}
+}
@@ -1,238 +1,327 @@
 package oauth1
 
 import (
-	"crypto/hmac"
-	"crypto/sha1"
-	"encoding/base64"
+	"context"
 	"fmt"
 	"github.com/nu7hatch/gouuid"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 )
 
 type Client struct {
-	Credentials Credentials  // client (app) credentials
-	Provider Provider
+	Credentials Credentials // client (app) credentials
+	Provider    Provider
 
-	Token           string  // user access token
-	Secret			string  // user token secret
+	Token  string // user access token
+	Secret string // user token secret
+
+	HTTPClient *http.Client           // sends requests, DefaultHTTPClient if nil
+	Now        func() time.Time       // clock for oauth_timestamp, time.Now if nil
+	Nonce      func() (string, error) // generates oauth_nonce, a random uuid if nil
+}
+
+// DefaultHTTPClient sends requests for clients without their own HTTPClient
+var DefaultHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+func (c Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return DefaultHTTPClient
+	}
+	return c.HTTPClient
+}
+
+func (c Client) now() time.Time {
+	if c.Now == nil {
+		return time.Now()
+	}
+	return c.Now()
+}
+
+func (c Client) nonce() (string, error) {
+	if c.Nonce == nil {
+		return uuidNonce()
+	}
+	return c.Nonce()
 }
 
 type Credentials struct {
-	consumerKey		string
-	consumerSecret	string
+	consumerKey    string
+	consumerSecret string
 }
 
 type Provider struct {
-	RequestTokenURL	string	// URL to get the initial request token
-	AuthorizeURL	string  // URL to authorize the returned temporary token
-	AccessTokenURL	string  // URL to get the final access credentials to make requests on behalf of the user
+	RequestTokenURL string // URL to get the initial request token
+	AuthorizeURL    string // URL to authorize the returned temporary token
+	AccessTokenURL  string // URL to get the final access credentials to make requests on behalf of the user
 
-	RequestURL		string	// URL to make requests to the API once authorization is done
-}
+	RequestURL string // URL to make requests to the API once authorization is done
 
-// lookup the consumer key & secret by convention from environment variables
-func CredentialsFromEnv(providerName string) Credentials {
+	Method              string // HTTP method for every request, GET if empty.  POST sends parameters as a form body.
+	AuthorizationHeader bool   // send the oauth_ parameters in an Authorization header instead of with the others
 
-	providerName = strings.ToUpper(providerName)
+	Signer Signer // signature method, HMACSHA1Signer if nil
+}
 
-	envName := fmt.Sprintf("%s_API_CONSUMER_KEY", providerName)
-	consumerKey := os.Getenv(envName)
-	if consumerKey == "" {
-		log.Fatal("Missing consumer key")
+func (p Provider) method() string {
+	if p.Method == "" {
+		return http.MethodGet
 	}
+	return strings.ToUpper(p.Method)
+}
 
-	envName = fmt.Sprintf("%s_API_CONSUMER_SECRET", providerName)
-	consumerSecret := os.Getenv("FATSECRET_API_CONSUMER_SECRET")
-	if consumerSecret == "" {
-		log.Fatal("Missing consumer secret")
+func (p Provider) signer() Signer {
+	if p.Signer == nil {
+		return HMACSHA1Signer{}
 	}
+	return p.Signer
+}
+
+// HTTPError is returned when the provider answers a request with a status other than 200 OK
+type HTTPError struct {
+	URL        string
+	StatusCode int
+	Body       string // the provider's response, which usually explains the problem
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("oauth request to %s failed with status %d: %s", e.URL, e.StatusCode, e.Body)
+}
+
+// Temporary reports whether retrying the request later might succeed: the provider is down or rate limiting
+func (e *HTTPError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// ResponseError is returned when a provider's response is missing something the protocol requires
+type ResponseError struct {
+	URL     string
+	Problem string
+	Body    string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("bad oauth response from %s: %s: %q", e.URL, e.Problem, e.Body)
+}
 
+// NewCredentials returns the client credentials the provider issued to the app
+func NewCredentials(consumerKey string, consumerSecret string) Credentials {
 	return Credentials{
-		consumerKey: consumerKey,
+		consumerKey:    consumerKey,
 		consumerSecret: consumerSecret,
 	}
 }
 
 // get the initial request token (step 1 of authorization)
-func (c Client) GetRequestToken(callbackURL string) (requestToken string, requestTokenSecret string) {
+func (c Client) GetRequestToken(ctx context.Context, callbackURL string) (requestToken string, requestTokenSecret string, err error) {
 
 	params := url.Values{}
 	params.Add("oauth_callback", callbackURL)
 
-	resp := sendSignedRequest(c.Provider.RequestTokenURL, c.Credentials, "", "", params)
+	resp, err := c.sendSignedRequest(ctx, c.Provider.RequestTokenURL, "", "", params)
+	if err != nil {
+		return "", "", err
+	}
 
 	// sample response: oauth_callback_confirmed=true&oauth_token=a0526f658e8542d5920f570b58a0ab4c&oauth_token_secret=ae0537b242e649929f3ee4e27256297a
 
-	values, err := url.ParseQuery(resp)
+	values, err := parseResponse(c.Provider.RequestTokenURL, resp)
 	if err != nil {
-		panic(err)
+		return "", "", err
 	}
 
 	if values.Get("oauth_callback_confirmed") != "true" {
-		log.Fatal("Callback not received")
+		return "", "", &ResponseError{URL: c.Provider.RequestTokenURL, Problem: "callback not confirmed", Body: resp}
 	}
 
 	requestToken = values.Get("oauth_token")
 	if requestToken == "" {
-		log.Fatal("No request token in response")
+		return "", "", &ResponseError{URL: c.Provider.RequestTokenURL, Problem: "no request token", Body: resp}
 	}
 
 	requestTokenSecret = values.Get("oauth_token_secret")
 	if requestTokenSecret == "" {
-		log.Fatal("No request token secret in response")
+		return "", "", &ResponseError{URL: c.Provider.RequestTokenURL, Problem: "no request token secret",
+			Body: resp}
 	}
 
-	fmt.Println(requestToken)
-	fmt.Println(requestTokenSecret)
-	return requestToken, requestTokenSecret
+	return requestToken, requestTokenSecret, nil
 }
 
 // get the URL the client needs to visit to authorize the temporary oauth request token returned in step 1
-func (c Client) GetAuthorizeURL(requestToken string) string {
+func (c Client) GetAuthorizeURL(requestToken string) (string, error) {
 
 	values := url.Values{}
 	values.Add("oauth_token", requestToken)
 
 	userAuthorizeURL, err := url.Parse(c.Provider.AuthorizeURL)
 	if err != nil {
-		panic(err)
+		return "", fmt.Errorf("bad authorize URL: %w", err)
 	}
 	userAuthorizeURL.RawQuery = values.Encode()
 
 	urlStr := userAuthorizeURL.String()
-	return urlStr
+	return urlStr, nil
 }
 
 // get an access token as last step of the auth process.  user credentials are added to the client instance
-func (c Client) GetAccessToken(requestToken string, requestTokenSecret string, verifier int) (oauthToken string, oauthTokenSecret string) {
+func (c Client) GetAccessToken(ctx context.Context, requestToken string, requestTokenSecret string, verifier string) (oauthToken string, oauthTokenSecret string, err error) {
 	// make another signed request, but this time the key differs because it includes the token secret returned
 	// with the request token
 
 	additionalParams := url.Values{}
-	additionalParams.Add("oauth_verifier", strconv.Itoa(verifier))
+	additionalParams.Add("oauth_verifier", verifier)
 
-	resp := sendSignedRequest(c.Provider.AccessTokenURL, c.Credentials, requestToken, requestTokenSecret, additionalParams)
+	resp, err := c.sendSignedRequest(ctx, c.Provider.AccessTokenURL, requestToken, requestTokenSecret,
+		additionalParams)
+	if err != nil {
+		return "", "", err
+	}
 
-	values, err := url.ParseQuery(resp)
+	values, err := parseResponse(c.Provider.AccessTokenURL, resp)
 	if err != nil {
-		panic(err)
+		return "", "", err
 	}
 
 	oauthToken = values.Get("oauth_token")
-
 	if oauthToken == "" {
-		log.Fatal("oauth token not in response!")
+		return "", "", &ResponseError{URL: c.Provider.AccessTokenURL, Problem: "no access token", Body: resp}
 	}
 
 	oauthTokenSecret = values.Get("oauth_token_secret")
-
 	if oauthTokenSecret == "" {
-		log.Fatal("oauth token secret not in response!")
+		return "", "", &ResponseError{URL: c.Provider.AccessTokenURL, Problem: "no access token secret",
+			Body: resp}
 	}
 
-	return oauthToken, oauthTokenSecret
+	return oauthToken, oauthTokenSecret, nil
 }
 
 // make a signed API call, params to be sent are passed in
-func (c Client) Request(params url.Values) string {
+func (c Client) Request(ctx context.Context, params url.Values) (string, error) {
 
-	return sendSignedRequest(c.Provider.RequestURL, c.Credentials, c.Token, c.Secret, params)
+	return c.sendSignedRequest(ctx, c.Provider.RequestURL, c.Token, c.Secret, params)
 }
 
+// token responses are form encoded
+func parseResponse(requestURL string, resp string) (url.Values, error) {
+	values, err := url.ParseQuery(resp)
+	if err != nil {
+		return nil, &ResponseError{URL: requestURL, Problem: "not form encoded", Body: resp}
+	}
+	return values, nil
+}
 
 // generate a uuid for the oauth nonce value
-func nonce() string {
+func uuidNonce() (string, error) {
 	u, err := uuid.NewV4()
 	if err != nil {
-		panic(err)
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
 	}
-	return u.String()
+	return u.String(), nil
 }
 
-func sendSignedRequest(requestURL string, credentials Credentials, token string, secret string, additionalParams url.Values) string {
-	method := "GET"
+// Sign and send a request.  The oauth_ protocol parameters are added to additionalParams, which may also hold
+// protocol parameters like oauth_callback.
+func (c Client) sendSignedRequest(ctx context.Context, requestURL string, token string, secret string,
+	additionalParams url.Values) (string, error) {
 
-	escapedRequestURL := url.QueryEscape(requestURL)
+	provider := c.Provider
+	credentials := c.Credentials
+	method := provider.method()
+	signer := provider.signer()
 
-	now := time.Now()
-	secs := now.Unix()
-	timestamp := strconv.FormatInt(secs, 10)
+	u, err := url.Parse(requestURL)
+	if err != nil {
+		return "", fmt.Errorf("bad request URL: %w", err)
+	}
 
-	params := url.Values{}
-	params.Add("oauth_consumer_key", credentials.consumerKey)
-	params.Add("oauth_signature_method", "HMAC-SHA1")
-	params.Add("oauth_timestamp", timestamp)
-	params.Add("oauth_nonce", nonce())
-	params.Add("oauth_version", "1.0")
+	nonce, err := c.nonce()
+	if err != nil {
+		return "", err
+	}
 
+	oauthParams := url.Values{}
+	oauthParams.Set("oauth_consumer_key", credentials.consumerKey)
+	oauthParams.Set("oauth_signature_method", signer.Method())
+	oauthParams.Set("oauth_timestamp", strconv.FormatInt(c.now().Unix(), 10))
+	oauthParams.Set("oauth_nonce", nonce)
+	oauthParams.Set("oauth_version", "1.0")
 	if token != "" {
-		params.Add("oauth_token", token)
+		oauthParams.Set("oauth_token", token)
 	}
 
-	if additionalParams != nil {
-		fmt.Println("addtl params: ", additionalParams)
-
-		for k, v := range additionalParams {
-			params.Add(k, v[0]) // don't support multiple values
+	params := url.Values{}
+	for name, values := range additionalParams {
+		for _, value := range values {
+			if strings.HasPrefix(name, "oauth_") {
+				oauthParams.Add(name, value)
+			} else {
+				params.Add(name, value)
+			}
 		}
 	}
 
-	fmt.Println("params: ", params)
-
-	encodedParams := params.Encode()
-
-	fmt.Println("encoded params: ", encodedParams)
-
-	escapedParams := url.QueryEscape(encodedParams)
-
-	signatureBaseString := fmt.Sprintf("%s&%s&%s", method, escapedRequestURL, escapedParams)
-	fmt.Println(signatureBaseString)
-
-	// signature
-	keyStr := credentials.consumerSecret + "&"
-	if secret != "" {
-		keyStr += secret
+	// the signature covers the query already in the URL, along with everything sent
+	signed := u.Query()
+	for _, p := range []url.Values{oauthParams, params} {
+		for name, values := range p {
+			signed[name] = append(signed[name], values...)
+		}
 	}
 
-	key := []byte(keyStr)
-	hash := hmac.New(sha1.New, key)
-	hash.Write([]byte(signatureBaseString))
-	sig := hash.Sum(nil)
-
+	baseString := signatureBaseString(method, u, signed)
+	signature, err := signer.Sign(baseString, credentials.consumerSecret, secret)
+	if err != nil {
+		return "", err
+	}
+	oauthParams.Set("oauth_signature", signature)
 
-	signature := base64.StdEncoding.EncodeToString(sig)
-	fmt.Println(signature)
+	if !provider.AuthorizationHeader {
+		for name, values := range oauthParams {
+			params[name] = append(params[name], values...)
+		}
+	}
 
-	params.Add("oauth_signature", signature)
+	var body io.Reader
+	if method == http.MethodPost {
+		body = strings.NewReader(normalizeParameters(params))
+	} else {
+		query := u.Query()
+		for name, values := range params {
+			query[name] = append(query[name], values...)
+		}
+		u.RawQuery = normalizeParameters(query)
+	}
 
-	req, err := http.NewRequest("GET", requestURL, nil)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
 	if err != nil {
-		panic(err)
+		return "", fmt.Errorf("bad request URL: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if provider.AuthorizationHeader {
+		req.Header.Set("Authorization", authorizationHeader(oauthParams))
 	}
 
-	encodedParams = params.Encode()
-	req.URL.RawQuery = encodedParams
-
-	client := http.Client{}
-	resp, err := client.Do(req)
+	resp, err := c.httpClient().Do(req)
 	if err != nil {
-		panic(err)
+		return "", fmt.Errorf("oauth request to %s failed: %w", requestURL, err)
 	}
 	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		panic(err)
+		return "", fmt.Errorf("failed to read oauth response from %s: %w", requestURL, err)
 	}
-	fmt.Println(string(body))
-
-	return string(body)
-}
 
+	if resp.StatusCode != http.StatusOK {
+		return "", &HTTPError{URL: requestURL, StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
 
+	return string(respBody), nil
+}
@@ -0,0 +1,229 @@
+package oauth1
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a request as the provider received it
+type receivedRequest struct {
+	method      string
+	contentType string
+	query       url.Values
+	body        url.Values
+	header      url.Values // from the Authorization header
+	url         *url.URL
+}
+
+func parseAuthorizationHeader(t *testing.T, header string) url.Values {
+
+	params := url.Values{}
+	if header == "" {
+		return params
+	}
+	if !strings.HasPrefix(header, "OAuth ") {
+		t.Fatalf("Authorization header %q isn't OAuth", header)
+	}
+
+	for _, pair := range strings.Split(strings.TrimPrefix(header, "OAuth "), ", ") {
+		eq := strings.Index(pair, "=")
+		if eq < 0 || !strings.HasPrefix(pair[eq+1:], `"`) || !strings.HasSuffix(pair, `"`) {
+			t.Fatalf("bad Authorization header parameter %q", pair)
+		}
+		name, err := url.PathUnescape(pair[:eq])
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := url.PathUnescape(pair[eq+2 : len(pair)-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		params.Add(name, value)
+	}
+	return params
+}
+
+// a provider recording each request and answering it with response
+func newRecordingProvider(t *testing.T, response string) (*httptest.Server, *receivedRequest) {
+
+	received := &receivedRequest{}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		err := req.ParseForm()
+		if err != nil {
+			t.Errorf("bad request: %s", err)
+		}
+
+		*received = receivedRequest{
+			method:      req.Method,
+			contentType: req.Header.Get("Content-Type"),
+			query:       req.URL.Query(),
+			body:        req.PostForm,
+			header:      parseAuthorizationHeader(t, req.Header.Get("Authorization")),
+			url:         &url.URL{Scheme: "http", Host: req.Host, Path: req.URL.Path},
+		}
+		rw.Write([]byte(response))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, received
+}
+
+// verify the signature the way a provider would, from every parameter it received
+func (r *receivedRequest) verify(t *testing.T, consumerSecret string, tokenSecret string) {
+
+	params := url.Values{}
+	for _, p := range []url.Values{r.query, r.body, r.header} {
+		for name, values := range p {
+			params[name] = append(params[name], values...)
+		}
+	}
+
+	signature := params.Get("oauth_signature")
+	params.Del("oauth_signature")
+
+	want, err := HMACSHA1Signer{}.Sign(signatureBaseString(r.method, r.url, params), consumerSecret, tokenSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signature != want {
+		t.Errorf("signature %q doesn't verify, want %q", signature, want)
+	}
+}
+
+func hasOAuthParams(values url.Values) bool {
+	for name := range values {
+		if strings.HasPrefix(name, "oauth_") {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRequestRoundTrip(t *testing.T) {
+
+	tests := []struct {
+		method string
+		header bool
+	}{
+		{http.MethodGet, false},
+		{http.MethodGet, true},
+		{http.MethodPost, false},
+		{http.MethodPost, true},
+	}
+
+	for _, tt := range tests {
+		name := tt.method
+		if tt.header {
+			name += " with Authorization header"
+		}
+
+		t.Run(name, func(t *testing.T) {
+
+			server, received := newRecordingProvider(t, "ok")
+
+			client := Client{
+				Credentials: NewCredentials("key", "consumer secret"),
+				Provider: Provider{
+					RequestURL:          server.URL + "/api?b5=%3D%253D&a3=a",
+					Method:              tt.method,
+					AuthorizationHeader: tt.header,
+				},
+				Token:  "token",
+				Secret: "token secret",
+			}
+
+			params := url.Values{"a3": {"2 q"}, "c2": {""}, "comment": {"☃ r b"}}
+			resp, err := client.Request(context.Background(), params)
+			if err != nil {
+				t.Fatalf("Request: %s", err)
+			}
+			if resp != "ok" {
+				t.Errorf("response %q, want ok", resp)
+			}
+
+			if received.method != tt.method {
+				t.Errorf("method %s, want %s", received.method, tt.method)
+			}
+			if received.query.Get("b5") != "=%3D" {
+				t.Errorf("the request URL's query was lost: %v", received.query)
+			}
+
+			sent := received.query
+			if tt.method == http.MethodPost {
+				sent = received.body
+				if received.contentType != "application/x-www-form-urlencoded" {
+					t.Errorf("POST content type %q", received.contentType)
+				}
+			} else if len(received.body) > 0 {
+				t.Errorf("GET had a body: %v", received.body)
+			}
+			if sent.Get("comment") != "☃ r b" || len(sent["a3"]) == 0 {
+				t.Errorf("parameters not sent: %v", sent)
+			}
+
+			if tt.header {
+				if received.header.Get("oauth_token") != "token" {
+					t.Errorf("no oauth_token in the Authorization header: %v", received.header)
+				}
+				if hasOAuthParams(received.query) || hasOAuthParams(received.body) {
+					t.Errorf("oauth_ parameters outside the Authorization header: %v %v", received.query, received.body)
+				}
+			} else {
+				if len(received.header) > 0 {
+					t.Errorf("unexpected Authorization header: %v", received.header)
+				}
+				if sent.Get("oauth_token") != "token" {
+					t.Errorf("no oauth_token in the parameters: %v", sent)
+				}
+			}
+
+			received.verify(t, "consumer secret", "token secret")
+		})
+	}
+}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// With a fixed clock and nonce the whole request is deterministic: this is OAuth Core 1.0 appendix A.5.3
+func TestGoldenRequest(t *testing.T) {
+
+	var sent string
+	client := Client{
+		Credentials: NewCredentials("dpf43f3p2l4k3l03", "kd94hf93k423kf44"),
+		Provider: Provider{
+			RequestURL: "http://photos.example.net/photos",
+		},
+		Token:  "nnch734d00sl2jdk",
+		Secret: "pfkkdhi9sl3r4s00",
+		HTTPClient: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			sent = req.URL.String()
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(strings.NewReader("photo")),
+			}, nil
+		})},
+		Now:   func() time.Time { return time.Unix(1191242096, 0) },
+		Nonce: func() (string, error) { return "kllo9940pd9333jh", nil },
+	}
+
+	_, err := client.Request(context.Background(), url.Values{"file": {"vacation.jpg"}, "size": {"original"}})
+	if err != nil {
+		t.Fatalf("Request: %s", err)
+	}
+
+	want := "http://photos.example.net/photos?file=vacation.jpg&oauth_consumer_key=dpf43f3p2l4k3l03&" +
+		"oauth_nonce=kllo9940pd9333jh&oauth_signature=tR3%2BTy81lMeYAr%2FFid0kMTYa%2FWM%3D&" +
+		"oauth_signature_method=HMAC-SHA1&oauth_timestamp=1191242096&oauth_token=nnch734d00sl2jdk&" +
+		"oauth_version=1.0&size=original"
+	if sent != want {
+		t.Errorf("request\n got %s\nwant %s", sent, want)
+	}
+}
@@ -0,0 +1,105 @@
+package oauth1
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Signing as described in RFC 5849 section 3.4: https://tools.ietf.org/html/rfc5849#section-3.4
+
+// percentEncode encodes s as RFC 5849 section 3.6 requires: every byte but the unreserved characters
+// (ALPHA, DIGIT, '-', '.', '_', '~') becomes %XX with uppercase hex digits.  Unlike url.QueryEscape a space
+// is %20, not '+'.
+func percentEncode(s string) string {
+	const hex = "0123456789ABCDEF"
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if unreserved(c) {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('%')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&15])
+		}
+	}
+	return b.String()
+}
+
+func unreserved(c byte) bool {
+	return 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+// normalizeParameters encodes every name and value, sorts by encoded name and then encoded value, and joins
+// them as name=value pairs with '&' (section 3.4.1.3.2).  Repeated names keep all their values.
+func normalizeParameters(params url.Values) string {
+
+	type pair struct{ name, value string }
+
+	pairs := make([]pair, 0, len(params))
+	for name, values := range params {
+		encodedName := percentEncode(name)
+		for _, value := range values {
+			pairs = append(pairs, pair{encodedName, percentEncode(value)})
+		}
+	}
+
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].name != pairs[j].name {
+			return pairs[i].name < pairs[j].name
+		}
+		return pairs[i].value < pairs[j].value
+	})
+
+	encoded := make([]string, 0, len(pairs))
+	for _, p := range pairs {
+		encoded = append(encoded, p.name+"="+p.value)
+	}
+	return strings.Join(encoded, "&")
+}
+
+// baseStringURI is the request URL without query or fragment, with the scheme and host lowercased and any
+// default port left out (section 3.4.1.2)
+func baseStringURI(u *url.URL) string {
+
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port != "" && !(scheme == "http" && port == "80") && !(scheme == "https" && port == "443") {
+		host += ":" + port
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	return scheme + "://" + host + path
+}
+
+// signatureBaseString joins the method, base string URI and normalized parameters (section 3.4.1).  params
+// must hold every parameter of the request: protocol parameters (but not oauth_signature), the query and
+// any form body.
+func signatureBaseString(method string, u *url.URL, params url.Values) string {
+	return strings.ToUpper(method) + "&" + percentEncode(baseStringURI(u)) + "&" +
+		percentEncode(normalizeParameters(params))
+}
+
+// authorizationHeader formats protocol parameters for the Authorization header (section 3.5.1)
+func authorizationHeader(oauthParams url.Values) string {
+
+	names := make([]string, 0, len(oauthParams))
+	for name := range oauthParams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, percentEncode(name)+`="`+percentEncode(oauthParams.Get(name))+`"`)
+	}
+	return "OAuth " + strings.Join(pairs, ", ")
+}
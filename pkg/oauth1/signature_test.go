@@ -0,0 +1,207 @@
+package oauth1
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestPercentEncode(t *testing.T) {
+
+	// RFC 5849 section 3.6
+	tests := []struct {
+		in, want string
+	}{
+		{"abcXYZ019", "abcXYZ019"},
+		{"-._~", "-._~"},
+		{"r b", "r%20b"},
+		{"a+b", "a%2Bb"},
+		{"=%3D", "%3D%253D"},
+		{"c@", "c%40"},
+		{"*!'()", "%2A%21%27%28%29"},
+		{"/?&", "%2F%3F%26"},
+		{"é", "%C3%A9"},
+		{"☃", "%E2%98%83"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		got := percentEncode(tt.in)
+		if got != tt.want {
+			t.Errorf("percentEncode(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeParameters(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		params url.Values
+		want   string
+	}{
+		{"repeated names sort by value", url.Values{"a": {"2", "1", "10"}}, "a=1&a=10&a=2"},
+		{"names sort before values", url.Values{"a1": {"x"}, "a": {"y"}}, "a=y&a1=x"},
+		{"empty values kept", url.Values{"c2": {""}, "b": {"x"}}, "b=x&c2="},
+		{"sorted after encoding", url.Values{"c@": {""}, "c2": {""}, "a3": {"2 q", "a"}}, "a3=2%20q&a3=a&c%40=&c2="},
+	}
+
+	for _, tt := range tests {
+		got := normalizeParameters(tt.params)
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBaseStringURI(t *testing.T) {
+
+	// RFC 5849 section 3.4.1.2
+	tests := []struct {
+		in, want string
+	}{
+		{"HTTP://EXAMPLE.COM:80/r%20v/X?id=123", "http://example.com/r%20v/X"},
+		{"https://www.example.net:8080/?q=1", "https://www.example.net:8080/"},
+		{"https://example.com:443", "https://example.com/"},
+		{"http://example.com/request#fragment", "http://example.com/request"},
+	}
+
+	for _, tt := range tests {
+		u, err := url.Parse(tt.in)
+		if err != nil {
+			t.Fatalf("bad URL %q: %s", tt.in, err)
+		}
+		got := baseStringURI(u)
+		if got != tt.want {
+			t.Errorf("baseStringURI(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// RFC 5849 section 3.4.1.1: query, form body and Authorization header parameters all go into the base string
+func TestSignatureBaseStringRFC5849(t *testing.T) {
+
+	u, err := url.Parse("http://example.com/request?b5=%3D%253D&a3=a&c%40=&a2=r%20b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params := u.Query()
+	params.Add("c2", "")
+	params.Add("a3", "2 q")
+	params.Add("oauth_consumer_key", "9djdj82h48djs9d2")
+	params.Add("oauth_token", "kkk9d7dh3k39sjv7")
+	params.Add("oauth_signature_method", "HMAC-SHA1")
+	params.Add("oauth_timestamp", "137131201")
+	params.Add("oauth_nonce", "7d8f3e4a")
+
+	want := "POST&http%3A%2F%2Fexample.com%2Frequest&a2%3Dr%2520b%26a3%3D2%2520q%26a3%3Da%26b5%3D%253D%25253D%26" +
+		"c%2540%3D%26c2%3D%26oauth_consumer_key%3D9djdj82h48djs9d2%26oauth_nonce%3D7d8f3e4a%26" +
+		"oauth_signature_method%3DHMAC-SHA1%26oauth_timestamp%3D137131201%26oauth_token%3Dkkk9d7dh3k39sjv7"
+
+	got := signatureBaseString("post", u, params)
+	if got != want {
+		t.Errorf("base string\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestHMACSHA1Signature(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		url    string
+		params url.Values
+		secret string
+		token  string
+		want   string
+	}{
+		{
+			// RFC 5849 section 1.2
+			name: "RFC 5849 photos.example.net",
+			url:  "http://photos.example.net/photos?file=vacation.jpg&size=original",
+			params: url.Values{
+				"oauth_consumer_key":     {"dpf43f3p2l4k3l03"},
+				"oauth_token":            {"nnch734d00sl2jdk"},
+				"oauth_signature_method": {"HMAC-SHA1"},
+				"oauth_timestamp":        {"137131202"},
+				"oauth_nonce":            {"chapoH"},
+			},
+			secret: "kd94hf93k423kf44",
+			token:  "pfkkdhi9sl3r4s00",
+			want:   "MdpQcU8iPSUjWoN/UDMsK2sui9I=",
+		},
+		{
+			// OAuth Core 1.0 appendix A.5, which also sends oauth_version like this package does
+			name: "OAuth Core 1.0 photos.example.net",
+			url:  "http://photos.example.net/photos?file=vacation.jpg&size=original",
+			params: url.Values{
+				"oauth_consumer_key":     {"dpf43f3p2l4k3l03"},
+				"oauth_token":            {"nnch734d00sl2jdk"},
+				"oauth_signature_method": {"HMAC-SHA1"},
+				"oauth_timestamp":        {"1191242096"},
+				"oauth_nonce":            {"kllo9940pd9333jh"},
+				"oauth_version":          {"1.0"},
+			},
+			secret: "kd94hf93k423kf44",
+			token:  "pfkkdhi9sl3r4s00",
+			want:   "tR3+Ty81lMeYAr/Fid0kMTYa/WM=",
+		},
+		{
+			// a weight.update call signed the way FatSecret's REST API documents, with a multi-byte comment
+			name: "FatSecret weight.update",
+			url:  "https://platform.fatsecret.com/rest/server.api",
+			params: url.Values{
+				"method":                 {"weight.update"},
+				"current_weight_kg":      {"80.5"},
+				"date":                   {"19650"},
+				"format":                 {"json"},
+				"weight_comment":         {"after run ☃"},
+				"oauth_consumer_key":     {"b0f3e2a1c4d5"},
+				"oauth_nonce":            {"6a8f2c1e-3b7d-4e9a-8c5f-0d2b4a6e8f10"},
+				"oauth_signature_method": {"HMAC-SHA1"},
+				"oauth_timestamp":        {"1697800000"},
+				"oauth_token":            {"f6e5d4c3b2a1"},
+				"oauth_version":          {"1.0"},
+			},
+			secret: "c0nsumers3cret",
+			token:  "t0kens3cret",
+			want:   "20+hSmYwCA40tJKq/NVkVkjFm90=",
+		},
+	}
+
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatalf("%s: bad URL: %s", tt.name, err)
+		}
+
+		params := u.Query()
+		for name, values := range tt.params {
+			params[name] = append(params[name], values...)
+		}
+
+		got, err := HMACSHA1Signer{}.Sign(signatureBaseString("GET", u, params), tt.secret, tt.token)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: signature %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAuthorizationHeader(t *testing.T) {
+
+	params := url.Values{
+		"oauth_signature":    {"wOJIO9A2W5mFwDgiDvZbTSMK/PY="},
+		"oauth_consumer_key": {"9djdj82h48djs9d2"},
+		"oauth_callback":     {"http://printer.example.com/ready"},
+	}
+
+	want := `OAuth oauth_callback="http%3A%2F%2Fprinter.example.com%2Fready", ` +
+		`oauth_consumer_key="9djdj82h48djs9d2", oauth_signature="wOJIO9A2W5mFwDgiDvZbTSMK%2FPY%3D"`
+
+	got := authorizationHeader(params)
+	if got != want {
+		t.Errorf("header\n got %s\nwant %s", got, want)
+	}
+}
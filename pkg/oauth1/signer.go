@@ -0,0 +1,108 @@
+package oauth1
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// Signer computes oauth_signature for a request (RFC 5849 section 3.4)
+type Signer interface {
+	// Method is the oauth_signature_method the signer implements
+	Method() string
+
+	// Sign signs the signature base string.  The secrets are the client's and, if there is one yet, the
+	// token's.
+	Sign(baseString string, consumerSecret string, tokenSecret string) (string, error)
+}
+
+// HMACSHA1Signer signs with HMAC-SHA1 keyed by both secrets (section 3.4.2).  It is the default.
+type HMACSHA1Signer struct{}
+
+func (HMACSHA1Signer) Method() string { return "HMAC-SHA1" }
+
+func (HMACSHA1Signer) Sign(baseString string, consumerSecret string, tokenSecret string) (string, error) {
+	return hmacSignature(sha1.New, baseString, consumerSecret, tokenSecret), nil
+}
+
+// HMACSHA256Signer signs like HMACSHA1Signer but with SHA-256, a common extension of the RFC
+type HMACSHA256Signer struct{}
+
+func (HMACSHA256Signer) Method() string { return "HMAC-SHA256" }
+
+func (HMACSHA256Signer) Sign(baseString string, consumerSecret string, tokenSecret string) (string, error) {
+	return hmacSignature(sha256.New, baseString, consumerSecret, tokenSecret), nil
+}
+
+func hmacSignature(h func() hash.Hash, baseString string, consumerSecret string, tokenSecret string) string {
+
+	key := percentEncode(consumerSecret) + "&" + percentEncode(tokenSecret)
+	mac := hmac.New(h, []byte(key))
+	mac.Write([]byte(baseString))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// RSASHA1Signer signs with the client's RSA private key (section 3.4.3).  The provider verifies with the
+// public key registered for the client, so the secrets aren't used.
+type RSASHA1Signer struct {
+	PrivateKey *rsa.PrivateKey
+}
+
+// NewRSASHA1Signer returns a signer for a PEM encoded PKCS #1 or PKCS #8 RSA private key
+func NewRSASHA1Signer(pemKey []byte) (*RSASHA1Signer, error) {
+
+	block, _ := pem.Decode(pemKey)
+	if block == nil {
+		return nil, errors.New("no PEM data found in RSA private key")
+	}
+
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err == nil {
+		return &RSASHA1Signer{PrivateKey: key}, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse RSA private key: %w", err)
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is %T, not RSA", parsed)
+	}
+	return &RSASHA1Signer{PrivateKey: key}, nil
+}
+
+func (s *RSASHA1Signer) Method() string { return "RSA-SHA1" }
+
+func (s *RSASHA1Signer) Sign(baseString string, consumerSecret string, tokenSecret string) (string, error) {
+
+	if s.PrivateKey == nil {
+		return "", errors.New("RSA-SHA1 signer has no private key")
+	}
+
+	digest := sha1.Sum([]byte(baseString))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.PrivateKey, crypto.SHA1, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign request: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// PlaintextSigner sends the secrets themselves as the signature (section 3.4.4).  It's only safe over TLS.
+type PlaintextSigner struct{}
+
+func (PlaintextSigner) Method() string { return "PLAINTEXT" }
+
+func (PlaintextSigner) Sign(baseString string, consumerSecret string, tokenSecret string) (string, error) {
+	return percentEncode(consumerSecret) + "&" + percentEncode(tokenSecret), nil
+}
@@ -0,0 +1,159 @@
+package oauth1
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// TemporaryCredentials are the request token and secret a flow keeps while the user authorizes the app
+type TemporaryCredentials struct {
+	Token   string
+	Secret  string
+	Expires time.Time
+}
+
+// TemporaryStore keeps a user's temporary credentials between beginning authorization and the callback.  Get
+// returns ErrNoTemporaryCredentials when there are none.
+type TemporaryStore interface {
+	Save(rw http.ResponseWriter, req *http.Request, creds TemporaryCredentials) error
+	Get(req *http.Request) (TemporaryCredentials, error)
+	Delete(rw http.ResponseWriter, req *http.Request) error
+}
+
+// KeyFunc identifies whose temporary credentials a request is for, typically by their user ID
+type KeyFunc func(req *http.Request) (string, error)
+
+// MemoryStore keeps temporary credentials in memory, so they are lost on restart and not shared between
+// processes.  Expired credentials are dropped as new ones are saved.
+type MemoryStore struct {
+	Key KeyFunc // required
+
+	mu    sync.Mutex
+	creds map[string]TemporaryCredentials
+}
+
+// ErrNoKeyFunc is returned by a MemoryStore without a Key func
+var ErrNoKeyFunc = errors.New("oauth1: MemoryStore has no Key func")
+
+func (m *MemoryStore) key(req *http.Request) (string, error) {
+	if m.Key == nil {
+		return "", ErrNoKeyFunc
+	}
+	return m.Key(req)
+}
+
+func (m *MemoryStore) Save(rw http.ResponseWriter, req *http.Request, creds TemporaryCredentials) error {
+
+	key, err := m.key(req)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.creds == nil {
+		m.creds = make(map[string]TemporaryCredentials)
+	}
+
+	now := time.Now()
+	for k, c := range m.creds {
+		if !now.Before(c.Expires) {
+			delete(m.creds, k)
+		}
+	}
+
+	m.creds[key] = creds
+	return nil
+}
+
+func (m *MemoryStore) Get(req *http.Request) (TemporaryCredentials, error) {
+
+	key, err := m.key(req)
+	if err != nil {
+		return TemporaryCredentials{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	creds, ok := m.creds[key]
+	if !ok {
+		return TemporaryCredentials{}, ErrNoTemporaryCredentials
+	}
+	return creds, nil
+}
+
+func (m *MemoryStore) Delete(rw http.ResponseWriter, req *http.Request) error {
+
+	key, err := m.key(req)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.creds, key)
+	return nil
+}
+
+// SessionStore keeps temporary credentials in the user's session.  With a cookie store the secret travels
+// to the browser, so the cookies should be encrypted, not just signed.
+type SessionStore struct {
+	Store       sessions.Store
+	SessionName string
+	Prefix      string // prefixes the session value names, to keep flows for different providers apart
+}
+
+func (s SessionStore) Save(rw http.ResponseWriter, req *http.Request, creds TemporaryCredentials) error {
+
+	session, err := s.Store.Get(req, s.SessionName)
+	if err != nil && session == nil {
+		return err
+	}
+
+	session.Values[s.Prefix+"token"] = creds.Token
+	session.Values[s.Prefix+"secret"] = creds.Secret
+	session.Values[s.Prefix+"expires"] = creds.Expires.Unix()
+	return session.Save(req, rw)
+}
+
+func (s SessionStore) Get(req *http.Request) (TemporaryCredentials, error) {
+
+	session, err := s.Store.Get(req, s.SessionName)
+	if err != nil && session == nil {
+		return TemporaryCredentials{}, err
+	}
+
+	token, _ := session.Values[s.Prefix+"token"].(string)
+	secret, _ := session.Values[s.Prefix+"secret"].(string)
+	expires, _ := session.Values[s.Prefix+"expires"].(int64)
+	if token == "" || secret == "" {
+		return TemporaryCredentials{}, ErrNoTemporaryCredentials
+	}
+
+	creds := TemporaryCredentials{
+		Token:   token,
+		Secret:  secret,
+		Expires: time.Unix(expires, 0),
+	}
+	return creds, nil
+}
+
+func (s SessionStore) Delete(rw http.ResponseWriter, req *http.Request) error {
+
+	session, err := s.Store.Get(req, s.SessionName)
+	if err != nil && session == nil {
+		return err
+	}
+
+	delete(session.Values, s.Prefix+"token")
+	delete(session.Values, s.Prefix+"secret")
+	delete(session.Values, s.Prefix+"expires")
+	return session.Save(req, rw)
+}
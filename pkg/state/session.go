@@ -1,21 +1,51 @@
 package state
 
 import (
+	"crypto/sha256"
+	"fmt"
 	"github.com/gorilla/sessions"
 	"io/ioutil"
-	"os"
-	"path/filepath"
+	"net/http"
 )
 
-func initSessionStore() *sessions.CookieStore {
+// how long a login lasts
+const sessionMaxAge = 60 * 60 * 24 * 30 // a month, in seconds
 
-	keyDir :=  filepath.Join(os.Getenv("HOME"), ".config", "wfsync")
-	keyFile := filepath.Join(keyDir, "sessionKeyFile")
+// read the session key written by storekeygen
+func readSessionKey(path string) ([]byte, error) {
 
-	key, err := ioutil.ReadFile(keyFile)
+	key, err := ioutil.ReadFile(path)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to read session key, run storekeygen to create it: %w", err)
 	}
 
-	return sessions.NewCookieStore(key)
+	return key, nil
+}
+
+// secure restricts the session cookie to https
+func initSessionStore(key []byte, secure bool) *sessions.CookieStore {
+
+	store := sessions.NewCookieStore(key)
+	store.Options = &sessions.Options{
+		Path:     "/",
+		MaxAge:   sessionMaxAge,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	return store
+}
+
+// derive the 32 byte key gorilla/csrf wants from the session key, so a separate key file isn't needed
+func csrfKey(sessionKey []byte) []byte {
+	sum := sha256.Sum256(append([]byte("wfsync-csrf:"), sessionKey...))
+	return sum[:]
+}
+
+// derive the key signing withings notify callback URLs from the session key, keeping it apart from the
+// session's own uses
+func notifyKey(sessionKey []byte) []byte {
+	sum := sha256.Sum256(append([]byte("wfsync-withings-notify:"), sessionKey...))
+	return sum[:]
 }
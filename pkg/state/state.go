@@ -4,43 +4,99 @@ import (
 	"database/sql"
 	"github.com/bdelliott/wfsync/pkg/fatsecret"
 	"github.com/gorilla/sessions"
-	"os"
+	"strings"
 
+	"github.com/bdelliott/wfsync/pkg/config"
+	"github.com/bdelliott/wfsync/pkg/credentials"
+	"github.com/bdelliott/wfsync/pkg/db"
 	"github.com/bdelliott/wfsync/pkg/withings"
 )
 
 // State is the top-level state object
 type State struct {
-	DB       *sql.DB
-	Withings *withings.State
-	FatSecret *fatsecret.State
-	SessionStore *sessions.CookieStore
+	Config        *config.Config
+	DB            *sql.DB
+	TokenKeys     *db.TokenKeys // encrypt and decrypt saved tokens
+	Withings      *withings.State
+	FatSecret     *fatsecret.State
+	SessionStore  *sessions.CookieStore
+	CSRFKey       []byte // authenticates csrf tokens
+	SecureCookies bool   // cookies are only sent over https
 
+	// user ids queued for an immediate sync, e.g. on a withings notification
+	SyncRequests chan string
 }
 
-// Init initialize the main auth State data struct
-func Init(db *sql.DB, withingsAuthCallbackURL string, fatSecretAuthCallbackURL string) *State {
+// size of the queue of user ids waiting for an immediate sync
+const syncRequestQueueSize = 100
 
-	withingsAPIKey := os.Getenv("WITHINGS_API_KEY")
-	withingsAPISecret := os.Getenv("WITHINGS_API_SECRET")
+// Init initialize the main auth State data struct from the config.  Both providers' API credentials are
+// loaded from creds, an error lists any that are missing.  Withings notifications are enabled when
+// cfg.WithingsNotifyURL is set.  keys encrypt saved tokens.
+func Init(sqlDB *sql.DB, keys *db.TokenKeys, cfg *config.Config, creds credentials.Source) (*State, error) {
+
+	apiCreds, err := credentials.LoadAll(creds, credentials.Withings, credentials.FatSecret)
+	if err != nil {
+		return nil, err
+	}
+	withingsCreds := apiCreds[credentials.Withings]
+	fatSecretCreds := apiCreds[credentials.FatSecret]
+
+	sessionKey, err := readSessionKey(cfg.SessionKeyFile)
+	if err != nil {
+		return nil, err
+	}
 
 	withingsState := withings.StateInit(
-		withingsAPIKey,
-		withingsAPISecret,
-		withingsAuthCallbackURL,
+		withingsCreds.Key,
+		withingsCreds.Secret,
+		cfg.WithingsAuthCallbackURL,
+		cfg.WithingsNotifyURL,
+		notifyKey(sessionKey),
 	)
 
+	withingsState.TokenKeys = keys
+
+	if cfg.WithingsNotifyURL != "" {
+		if cfg.WithingsNotifyFake {
+			withingsState.Notifier = withings.NewFakeNotifier()
+		} else {
+			withingsState.Notifier = withings.NewAPINotifier(withingsState, sqlDB)
+		}
+	}
+
 	fatSecretState := fatsecret.StateInit(
-		fatSecretAuthCallbackURL,
+		fatSecretCreds.Key,
+		fatSecretCreds.Secret,
+		cfg.FatSecretAuthCallbackURL,
 	)
 
-	store := initSessionStore()
+	// cookies can be https only when the app is served over https, as its callbacks are
+	secureCookies := strings.HasPrefix(cfg.WithingsAuthCallbackURL, "https://")
+
+	store := initSessionStore(sessionKey, secureCookies)
 	state := State{
-		DB:       db,
-		Withings: withingsState,
-		FatSecret: fatSecretState,
-		SessionStore: store,
+		Config:        cfg,
+		DB:            sqlDB,
+		TokenKeys:     keys,
+		Withings:      withingsState,
+		FatSecret:     fatSecretState,
+		SessionStore:  store,
+		CSRFKey:       csrfKey(sessionKey),
+		SecureCookies: secureCookies,
+		SyncRequests:  make(chan string, syncRequestQueueSize),
 	}
 
-	return &state
-}
\ No newline at end of file
+	return &state, nil
+}
+
+// RequestSync queues the user for an immediate sync.  If the queue is full the request is dropped, and the
+// user is picked up on their next regular sync instead.
+func (s *State) RequestSync(userID string) bool {
+	select {
+	case s.SyncRequests <- userID:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,87 @@
+package units
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+
+	"github.com/bdelliott/wfsync/pkg/db"
+)
+
+// Unit is a unit weights are displayed in
+type Unit string
+
+// Supported display units
+const (
+	Kilograms Unit = "kg"
+	Pounds    Unit = "lb"
+	Stone     Unit = "st"
+)
+
+// Units lists the supported display units
+var Units = []Unit{Kilograms, Pounds, Stone}
+
+const (
+	// exact, by definition of the international pound
+	kgPerPound     = 0.45359237
+	poundsPerStone = 14
+
+	displayUnitSetting = "displayUnit"
+)
+
+// Parse validates a unit name
+func Parse(name string) (Unit, error) {
+	for _, unit := range Units {
+		if Unit(name) == unit {
+			return unit, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported unit %q", name)
+}
+
+// KgToPounds converts a weight in kilograms to pounds
+func KgToPounds(kg float64) float64 {
+	return kg / kgPerPound
+}
+
+// Format renders a weight in kilograms in the given unit, e.g. "80.3 kg", "177.0 lb" or "12 st 9.0 lb"
+func Format(kg float64, unit Unit) string {
+	switch unit {
+	case Pounds:
+		return fmt.Sprintf("%.1f lb", KgToPounds(kg))
+	case Stone:
+		// round first, so that 13.96 lb left over shows as the next stone rather than "14.0 lb"
+		pounds := math.Round(KgToPounds(kg)*10) / 10
+		stone := math.Floor(pounds / poundsPerStone)
+		return fmt.Sprintf("%.0f st %.1f lb", stone, pounds-stone*poundsPerStone)
+	default:
+		return fmt.Sprintf("%.1f kg", kg)
+	}
+}
+
+// UserUnitGet returns the unit the user wants weights displayed in
+func UserUnitGet(ctx context.Context, sqlDB *sql.DB, userID string) (Unit, error) {
+
+	value, err := db.UserSettingGet(ctx, sqlDB, userID, displayUnitSetting)
+	if err == db.ErrNotFound {
+		return Kilograms, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	unit, err := Parse(value)
+	if err != nil {
+		log.Printf("Ignoring bad display unit for user %s: %s", userID, err)
+		return Kilograms, nil
+	}
+
+	return unit, nil
+}
+
+// UserUnitSave saves the unit the user wants weights displayed in
+func UserUnitSave(ctx context.Context, sqlDB *sql.DB, userID string, unit Unit) error {
+	return db.UserSettingSave(ctx, sqlDB, userID, displayUnitSetting, string(unit))
+}
@@ -0,0 +1,73 @@
+package units
+
+import (
+	"math"
+	"testing"
+)
+
+func TestKgToPounds(t *testing.T) {
+
+	tests := []struct {
+		kg   float64
+		want float64
+	}{
+		{0, 0},
+		{0.45359237, 1},
+		{1, 2.2046226218},
+		{80.3, 177.0311965},
+		{100, 220.4622622},
+	}
+
+	for _, tt := range tests {
+		got := KgToPounds(tt.kg)
+		if math.Abs(got-tt.want) > 1e-6 {
+			t.Errorf("KgToPounds(%v) = %v, want %v", tt.kg, got, tt.want)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+
+	tests := []struct {
+		kg   float64
+		unit Unit
+		want string
+	}{
+		{80.3, Kilograms, "80.3 kg"},
+		{80.25, Kilograms, "80.2 kg"}, // 80.25 is just below, as a float
+		{80.26, Kilograms, "80.3 kg"},
+		{80.3, Pounds, "177.0 lb"},
+		{100, Pounds, "220.5 lb"},
+		{80.3, Stone, "12 st 9.0 lb"},
+		{63.5029318, Stone, "10 st 0.0 lb"}, // exactly 140 lb
+		{63.4849, Stone, "10 st 0.0 lb"},    // 139.96 lb rounds up to the next stone
+		{63.4576, Stone, "9 st 13.9 lb"},    // 139.9 lb
+		{6.35029318, Stone, "1 st 0.0 lb"},  // exactly 14 lb
+		{0.2, Stone, "0 st 0.4 lb"},
+		{80.3, Unit("furlongs"), "80.3 kg"}, // unknown units fall back to kg
+	}
+
+	for _, tt := range tests {
+		got := Format(tt.kg, tt.unit)
+		if got != tt.want {
+			t.Errorf("Format(%v, %s) = %q, want %q", tt.kg, tt.unit, got, tt.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+
+	for _, unit := range Units {
+		got, err := Parse(string(unit))
+		if err != nil || got != unit {
+			t.Errorf("Parse(%q) = %q, %v", unit, got, err)
+		}
+	}
+
+	for _, name := range []string{"", "KG", "stone", "g"} {
+		_, err := Parse(name)
+		if err == nil {
+			t.Errorf("Parse(%q) succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bdelliott/wfsync/pkg/db"
+	"github.com/bdelliott/wfsync/pkg/export"
+	"github.com/bdelliott/wfsync/pkg/state"
+	"github.com/bdelliott/wfsync/pkg/withings"
+	"github.com/gorilla/csrf"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const deleteAccountTemplate = "templates/deleteAccount.html"
+
+// data for the account deletion page
+type deleteAccountPage struct {
+	UserName  string
+	Error     string
+	Deleted   bool
+	CSRFField template.HTML
+}
+
+// Download a ZIP of everything saved for the user
+func exportHandler(rw http.ResponseWriter, req *http.Request, s *state.State) {
+
+	user, exists := getUser(rw, req, s)
+	if !exists {
+		return // redirect was issued.
+	}
+
+	// build the whole archive first, so a failure can still be reported as an error
+	var buf bytes.Buffer
+	err := export.Write(req.Context(), s.DB, user, &buf)
+	if err != nil {
+		serverError(rw, "Failed to export data", err)
+		return
+	}
+
+	fileName := fmt.Sprintf("wfsync-%s-%s.zip", user.UserName, time.Now().Format("2006-01-02"))
+
+	rw.Header().Set("Content-Type", "application/zip")
+	rw.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(fileName))
+	rw.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	_, err = buf.WriteTo(rw)
+	if err != nil {
+		log.Print("Failed to send export: ", err)
+	}
+}
+
+// Delete the user's account and all of their data, after they confirm with their password
+func deleteAccountHandler(rw http.ResponseWriter, req *http.Request, s *state.State) {
+
+	user, exists := getUser(rw, req, s)
+	if !exists {
+		return // redirect was issued.
+	}
+
+	page := deleteAccountPage{
+		UserName:  user.UserName,
+		CSRFField: csrf.TemplateField(req),
+	}
+
+	if req.Method == "GET" {
+		renderTemplate(rw, s, deleteAccountTemplate, page)
+		return
+	}
+
+	if req.Method != "POST" {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	password := req.PostFormValue("password")
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		page.Error = "Wrong password."
+		rw.WriteHeader(http.StatusUnauthorized)
+		renderTemplate(rw, s, deleteAccountTemplate, page)
+		return
+	}
+
+	// revoke the subscription while we still have a token to authorize the request with
+	err := withings.Unsubscribe(req.Context(), s.Withings, user.UserID)
+	if err != nil {
+		// not fatal, notifications for a deleted user are ignored
+		log.Printf("Failed to unsubscribe user %s from withings notifications: %s", user.UserID, err)
+	}
+
+	err = db.UserDelete(req.Context(), s.DB, user.UserID)
+	if err != nil {
+		serverError(rw, "Failed to delete account", err)
+		return
+	}
+
+	err = clearSession(rw, req, s)
+	if err != nil {
+		serverError(rw, "Failed to clear session", err)
+		return
+	}
+
+	page.Deleted = true
+	renderTemplate(rw, s, deleteAccountTemplate, page)
+}
@@ -0,0 +1,188 @@
+package web
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+
+	"github.com/bdelliott/wfsync/pkg/db"
+	"github.com/bdelliott/wfsync/pkg/state"
+	"github.com/gorilla/csrf"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	registerTemplate = "templates/register.html"
+
+	minPasswordLength = 8
+)
+
+// compared against when the user name is unknown, so a failed login takes as long whether or not the account
+// exists
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not anyone's password"), bcrypt.DefaultCost)
+
+// data for the login and registration pages
+type authPage struct {
+	UserName  string
+	Error     string
+	CSRFField template.HTML
+}
+
+// Handle user login
+func loginHandler(s *state.State) func(rw http.ResponseWriter, req *http.Request) {
+
+	return func(rw http.ResponseWriter, req *http.Request) {
+
+		page := authPage{CSRFField: csrf.TemplateField(req)}
+
+		if req.Method == "GET" {
+			renderTemplate(rw, s, loginTemplate, page)
+			return
+		}
+
+		if req.Method != "POST" {
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		page.UserName = req.PostFormValue("username")
+		password := req.PostFormValue("password")
+
+		user, err := db.UserGetByName(req.Context(), s.DB, page.UserName)
+		if err != nil && err != db.ErrNotFound {
+			serverError(rw, "Failed to look up user", err)
+			return
+		}
+
+		passwordHash := dummyPasswordHash
+		if err == nil {
+			passwordHash = []byte(user.PasswordHash)
+		}
+
+		if bcrypt.CompareHashAndPassword(passwordHash, []byte(password)) != nil || err == db.ErrNotFound {
+			log.Printf("Failed login for user name %q", page.UserName)
+			page.Error = "Unknown user name or wrong password."
+			rw.WriteHeader(http.StatusUnauthorized)
+			renderTemplate(rw, s, loginTemplate, page)
+			return
+		}
+
+		err = setSessionUserID(rw, req, s, user.UserID)
+		if err != nil {
+			serverError(rw, "Failed to save session", err)
+			return
+		}
+
+		http.Redirect(rw, req, "/", http.StatusFound)
+	}
+}
+
+// Handle creation of a new account
+func registerHandler(s *state.State) func(rw http.ResponseWriter, req *http.Request) {
+
+	return func(rw http.ResponseWriter, req *http.Request) {
+
+		page := authPage{CSRFField: csrf.TemplateField(req)}
+
+		if req.Method == "GET" {
+			renderTemplate(rw, s, registerTemplate, page)
+			return
+		}
+
+		if req.Method != "POST" {
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		page.UserName = req.PostFormValue("username")
+		password := req.PostFormValue("password")
+
+		if page.UserName == "" {
+			page.Error = "Please choose a user name."
+		} else if len(password) < minPasswordLength {
+			page.Error = "Passwords need at least 8 characters."
+		} else if password != req.PostFormValue("confirm") {
+			page.Error = "The passwords don't match."
+		}
+
+		if page.Error != "" {
+			rw.WriteHeader(http.StatusBadRequest)
+			renderTemplate(rw, s, registerTemplate, page)
+			return
+		}
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			serverError(rw, "Failed to hash password", err)
+			return
+		}
+
+		userID, err := newUserID()
+		if err != nil {
+			serverError(rw, "Failed to create user id", err)
+			return
+		}
+
+		user := db.User{
+			UserID:       userID,
+			UserName:     page.UserName,
+			PasswordHash: string(hash),
+		}
+
+		err = db.UserCreate(req.Context(), s.DB, user)
+		if err == db.ErrExists {
+			page.Error = "That user name is taken."
+			rw.WriteHeader(http.StatusConflict)
+			renderTemplate(rw, s, registerTemplate, page)
+			return
+		}
+		if err != nil {
+			serverError(rw, "Failed to save user", err)
+			return
+		}
+
+		err = setSessionUserID(rw, req, s, user.UserID)
+		if err != nil {
+			serverError(rw, "Failed to save session", err)
+			return
+		}
+
+		http.Redirect(rw, req, "/", http.StatusFound)
+	}
+}
+
+// Logout the user
+func logoutHandler(s *state.State) func(rw http.ResponseWriter, req *http.Request) {
+
+	return func(rw http.ResponseWriter, req *http.Request) {
+
+		// logging out changes state, so it takes a csrf protected POST
+		if req.Method != "POST" {
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		err := clearSession(rw, req, s)
+		if err != nil {
+			serverError(rw, "Failed to clear session", err)
+			return
+		}
+
+		renderTemplate(rw, s, logoutTemplate, nil)
+	}
+}
+
+// log the user out by deleting their session
+func clearSession(rw http.ResponseWriter, req *http.Request, s *state.State) error {
+
+	session := getSession(s, req)
+	session.Values = make(map[interface{}]interface{})
+	session.Options.MaxAge = -1 // means delete now
+
+	return session.Save(req, rw)
+}
+
+// a random, unguessable user id
+func newUserID() (string, error) {
+	return randomHex(16)
+}
@@ -0,0 +1,71 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/sessions"
+
+	"github.com/bdelliott/wfsync/pkg/db"
+	"github.com/bdelliott/wfsync/pkg/state"
+)
+
+// state with a migrated db and a session store
+func newAuthState(t *testing.T) *state.State {
+
+	sqlDB, err := db.Open(filepath.Join(t.TempDir(), "wfsync.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	err = db.Migrate(context.Background(), sqlDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &state.State{
+		DB:           sqlDB,
+		SessionStore: sessions.NewCookieStore([]byte("0123456789abcdef0123456789abcdef")),
+	}
+}
+
+// a session for a user no longer in the db is cleared, and the user sent to log in
+func TestGetUserStaleSession(t *testing.T) {
+
+	s := newAuthState(t)
+
+	login := httptest.NewRecorder()
+	err := setSessionUserID(login, httptest.NewRequest("POST", "/login", nil), s, "deleted")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range login.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+
+	rw := httptest.NewRecorder()
+	_, ok := getUser(rw, req, s)
+	if ok {
+		t.Fatal("got a user for a deleted account")
+	}
+
+	if rw.Code != http.StatusSeeOther || rw.Header().Get("Location") != "/login" {
+		t.Errorf("got %d to %q, want a redirect to /login", rw.Code, rw.Header().Get("Location"))
+	}
+
+	cleared := false
+	for _, cookie := range rw.Result().Cookies() {
+		if cookie.Name == sessionName && cookie.MaxAge < 0 {
+			cleared = true
+		}
+	}
+	if !cleared {
+		t.Errorf("session cookie not cleared: %v", rw.Result().Cookies())
+	}
+}
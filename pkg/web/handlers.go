@@ -1,44 +1,81 @@
 package web
 
 import (
+	"crypto/subtle"
+	"errors"
 	"fmt"
-	"github.com/bdelliott/wfsync/pkg/fatsecret"
+	"github.com/gorilla/csrf"
 	"github.com/gorilla/sessions"
 	"html/template"
 	"log"
 	"net/http"
-	"strconv"
+	"path/filepath"
+	"time"
 
 	"github.com/bdelliott/wfsync/pkg/db"
+	"github.com/bdelliott/wfsync/pkg/oauth1"
 	"github.com/bdelliott/wfsync/pkg/state"
+	"github.com/bdelliott/wfsync/pkg/units"
 	"github.com/bdelliott/wfsync/pkg/withings"
+	"github.com/bdelliott/wfsync/pkg/worker"
 )
 
 const (
-	homeTemplate   = "assets/templates/home.html"
-	loginTemplate  = "assets/templates/login.html"
-	logoutTemplate = "assets/templates/logout.html"
+	homeTemplate   = "templates/home.html"
+	loginTemplate  = "templates/login.html"
+	logoutTemplate = "templates/logout.html"
+	errorTemplate  = "templates/error.html"
 
-	// cookie to identify user:
-	userIDCookie = "userid"
+	// name of the session cookie
+	sessionName = "wfsync"
+
+	// number of weights shown on the home page
+	recentWeights = 10
 
 	// session keys
-	sessionRequestToken = "requestToken"
-	sessionRequestTokenSecret = "requestTokenSecret"
+	sessionUserID        = "userID"
+	sessionWithingsState = "withingsState"
 )
 
 // Render the home page for a logged in user
 func home(rw http.ResponseWriter, req *http.Request, state *state.State) {
 
-	t, err := template.ParseFiles(homeTemplate)
+	t, err := template.ParseFiles(filepath.Join(state.Config.AssetDir, homeTemplate))
 	if err != nil {
-		log.Fatalf("Failed to parse template %s %s", homeTemplate, err)
+		serverError(rw, "Failed to parse template "+homeTemplate, err)
+		return
+	}
+
+	type Option struct {
+		Value    string
+		Label    string
+		Selected bool
+	}
+
+	type WeightRow struct {
+		Date   string
+		Weight string
+	}
+
+	type DisagreementRow struct {
+		Date       string
+		Withings   string
+		FatSecret  string
+		ManualEdit bool
 	}
 
 	type HomeData struct {
-		UserName       string
-		WithingsState  string
-		FatSecretState string
+		UserName        string
+		WithingsState   string
+		WithingsLinked  bool
+		FatSecretState  string
+		FatSecretLinked bool
+		SyncIntervals   []Option
+		Units           []Option
+		Policies        []Option
+		Weights         []WeightRow
+		Disagreements   []DisagreementRow
+		CSRFField       template.HTML
 	}
 
 	user, exists := getUser(rw, req, state)
@@ -46,17 +83,115 @@ func home(rw http.ResponseWriter, req *http.Request, state *state.State) {
 		return // redirect was issued.
 	}
 
-	_, withingsTokenExists := db.WithingsTokenGet(state.DB, user)
-	_, _, fatSecretTokenExists := db.FatSecretTokenGet(state.DB, user)
+	ctx := req.Context()
+
+	withingsTokenExists, err := db.WithingsTokenExists(ctx, state.DB, user)
+	if err != nil {
+		serverError(rw, "Failed to look up Withings link", err)
+		return
+	}
+
+	fatSecretTokenExists, err := db.FatSecretTokenExists(ctx, state.DB, user)
+	if err != nil {
+		serverError(rw, "Failed to look up FatSecret link", err)
+		return
+	}
+
+	syncInterval, err := worker.SyncIntervalGet(ctx, state, user.UserID)
+	if err != nil {
+		serverError(rw, "Failed to look up sync interval", err)
+		return
+	}
+	syncIntervals := make([]Option, 0)
+	for _, interval := range worker.SyncIntervals {
+		option := Option{
+			Value:    interval.String(),
+			Selected: interval == syncInterval,
+		}
+		syncIntervals = append(syncIntervals, option)
+	}
+
+	policy, err := worker.PolicyGet(ctx, state, user.UserID)
+	if err != nil {
+		serverError(rw, "Failed to look up reconcile policy", err)
+		return
+	}
+	policies := make([]Option, 0)
+	for _, p := range worker.Policies {
+		option := Option{
+			Value:    string(p),
+			Label:    p.Label(),
+			Selected: p == policy,
+		}
+		policies = append(policies, option)
+	}
+
+	// weights are kept in kg, and only converted for display:
+	displayUnit, err := units.UserUnitGet(ctx, state.DB, user.UserID)
+	if err != nil {
+		serverError(rw, "Failed to look up display unit", err)
+		return
+	}
+	unitOptions := make([]Option, 0)
+	for _, unit := range units.Units {
+		option := Option{
+			Value:    string(unit),
+			Selected: unit == displayUnit,
+		}
+		unitOptions = append(unitOptions, option)
+	}
+
+	recent, err := db.WeightsRecent(ctx, state.DB, user.UserID, recentWeights)
+	if err != nil {
+		serverError(rw, "Failed to look up recent weights", err)
+		return
+	}
+
+	weights := make([]WeightRow, 0)
+	for _, weight := range recent {
+		row := WeightRow{
+			Date:   time.Unix(weight.Timestamp, 0).Format("2006-01-02 15:04"),
+			Weight: units.Format(weight.Kg(), displayUnit),
+		}
+		weights = append(weights, row)
+	}
+
+	disagreements := make([]DisagreementRow, 0)
+	if fatSecretTokenExists {
+		days, err := worker.Disagreements(ctx, state, user.UserID, recentWeights)
+		if err != nil {
+			serverError(rw, "Failed to compare Withings and FatSecret weights", err)
+			return
+		}
+
+		for _, day := range days {
+			row := DisagreementRow{
+				Date:       day.Date.Format("2006-01-02"),
+				Withings:   units.Format(day.WithingsKg, displayUnit),
+				FatSecret:  units.Format(day.FatSecretKg, displayUnit),
+				ManualEdit: day.ManualEdit,
+			}
+			disagreements = append(disagreements, row)
+		}
+	}
 
 	data := HomeData{
-		UserName:       user.UserName,
-		WithingsState:  linkStr(withingsTokenExists),
-		FatSecretState: linkStr(fatSecretTokenExists),
+		UserName:        user.UserName,
+		WithingsState:   linkStr(withingsTokenExists),
+		WithingsLinked:  withingsTokenExists,
+		FatSecretState:  linkStr(fatSecretTokenExists),
+		FatSecretLinked: fatSecretTokenExists,
+		SyncIntervals:   syncIntervals,
+		Units:           unitOptions,
+		Policies:        policies,
+		Weights:         weights,
+		Disagreements:   disagreements,
+		CSRFField:       csrf.TemplateField(req),
 	}
 	err = t.Execute(rw, data)
 	if err != nil {
-		log.Fatalf("Failed to execute template %s %s", homeTemplate, err)
+		log.Printf("Failed to execute template %s %s", homeTemplate, err)
+		return
 	}
 }
 
@@ -68,83 +203,100 @@ func linkStr(haveToken bool) string {
 	return "Not Linked"
 }
 
-// Handle user login
-func loginHandler(s *state.State) func(rw http.ResponseWriter, req *http.Request) {
+// Save the user's choice of how often to sync
+func syncIntervalHandler(rw http.ResponseWriter, req *http.Request, s *state.State) {
 
-	return func(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-		if req.Method == "GET" {
-			t, err := template.ParseFiles(loginTemplate)
-			if err != nil {
-				log.Fatalf("Failed to parse login template %s %s", loginTemplate, err)
-			}
+	err := req.ParseForm()
+	if err != nil {
+		msg := fmt.Sprint("Error parsing form values", err)
+		log.Print(msg)
+		http.Error(rw, msg, http.StatusBadRequest)
+		return
+	}
 
-			err = t.Execute(rw, nil)
-			if err != nil {
-				log.Fatalf("Failed to execute login template %s %s", loginTemplate, err)
-			}
+	interval, err := time.ParseDuration(req.Form.Get("interval"))
+	if err != nil {
+		http.Error(rw, "Invalid sync interval", http.StatusBadRequest)
+		return
+	}
 
-		} else if req.Method == "POST" {
+	user, exists := getUser(rw, req, s)
+	if !exists {
+		return // redirect was issued.
+	}
 
-			err := req.ParseForm()
-			if err != nil {
-				panic(err)
-			}
+	err = worker.SyncIntervalSave(req.Context(), s, user.UserID, interval)
+	if errors.Is(err, worker.ErrUnsupportedSyncInterval) {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		serverError(rw, "Failed to save sync interval", err)
+		return
+	}
 
-			userID := req.Form.Get("userid")
-			userName := req.Form.Get("username")
+	http.Redirect(rw, req, "/", http.StatusFound)
+}
 
-			db.UserSave(s.DB, userID, userName)
+// Save how the user wants Withings weigh-ins reconciled with FatSecret's one weight a day
+func reconcilePolicyHandler(rw http.ResponseWriter, req *http.Request, s *state.State) {
 
-			cookie := &http.Cookie{
-				Name:   userIDCookie,
-				Value:  userID,
-				Path:   "/",
-				MaxAge: 60 * 60 * 24 * 365, // a year, in seconds
-			}
-			http.SetCookie(rw, cookie)
+	if req.Method != "POST" {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-			http.Redirect(rw, req, "/", http.StatusFound)
-		}
+	err := req.ParseForm()
+	if err != nil {
+		msg := fmt.Sprint("Error parsing form values", err)
+		log.Print(msg)
+		http.Error(rw, msg, http.StatusBadRequest)
+		return
 	}
-}
 
-// Redirect user to the oauth login page for Withings
-func linkWithings(rw http.ResponseWriter, req *http.Request, s *state.State) {
+	user, exists := getUser(rw, req, s)
+	if !exists {
+		return // redirect was issued.
+	}
 
-	withingsAuthorizationURL := withings.GetAuthorizationURL(s.Withings)
-	http.Redirect(rw, req, withingsAuthorizationURL, http.StatusSeeOther)
+	err = worker.PolicySave(req.Context(), s, user.UserID, worker.Policy(req.Form.Get("policy")))
+	if errors.Is(err, worker.ErrUnsupportedPolicy) {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		serverError(rw, "Failed to save reconcile policy", err)
+		return
+	}
+
+	http.Redirect(rw, req, "/", http.StatusFound)
 }
 
-// Logout the user
-func logoutHandler(rw http.ResponseWriter, req *http.Request) {
+// Redirect user to the oauth login page for Withings
+func linkWithings(rw http.ResponseWriter, req *http.Request, s *state.State) {
 
-	// delete cookie:
-	cookie, err := req.Cookie(userIDCookie)
+	// the state comes back on the callback, proving the user started the link from this session
+	oauthState, err := randomHex(16)
 	if err != nil {
-		log.Print("Failed to retrieve user id cookie: ", err)
-	} else {
-		log.Print("Deleting cookie")
-		userID := cookie.Value
-
-		cookie = &http.Cookie{
-			Name:   userIDCookie,
-			Value:  userID,
-			Path:   "/",
-			MaxAge: -1, // means delete now
-		}
-		http.SetCookie(rw, cookie)
+		serverError(rw, "Failed to generate OAuth state", err)
+		return
 	}
 
-	t, err := template.ParseFiles(logoutTemplate)
+	session := getSession(s, req)
+	session.Values[sessionWithingsState] = oauthState
+	err = session.Save(req, rw)
 	if err != nil {
-		log.Fatalf("Failed to parse template %s %s", logoutTemplate, err)
+		serverError(rw, "Failed to save session", err)
+		return
 	}
 
-	err = t.Execute(rw, nil)
-	if err != nil {
-		log.Fatalf("Failed to execute template %s %s", logoutTemplate, err)
-	}
+	withingsAuthorizationURL := withings.GetAuthorizationURL(s.Withings, oauthState)
+	http.Redirect(rw, req, withingsAuthorizationURL, http.StatusSeeOther)
 }
 
 // To be called after user authorizes the app with the Withings API.
@@ -157,6 +309,32 @@ func withingsCallback(rw http.ResponseWriter, req *http.Request, s *state.State)
 		return
 	}
 
+	// the state is only good for one attempt
+	session := getSession(s, req)
+	expectedState, _ := session.Values[sessionWithingsState].(string)
+	delete(session.Values, sessionWithingsState)
+	err = session.Save(req, rw)
+	if err != nil {
+		serverError(rw, "Failed to save session", err)
+		return
+	}
+
+	callbackState := req.Form.Get("state")
+	if expectedState == "" || callbackState == "" ||
+		subtle.ConstantTimeCompare([]byte(expectedState), []byte(callbackState)) != 1 {
+
+		log.Print("Rejecting withings callback with missing or mismatched state")
+		errorPage(rw, s, http.StatusBadRequest,
+			"This Withings link request has expired or didn't come from this session. Please try linking again.")
+		return
+	}
+
+	if req.Form.Get("error") != "" {
+		log.Print("Withings authorization declined: ", req.Form.Get("error"))
+		errorPage(rw, s, http.StatusBadRequest, "Withings access was not granted, so your account was not linked.")
+		return
+	}
+
 	token, err := withings.ExchangeToken(s.Withings, req)
 	if err != nil {
 		msg := fmt.Sprint("Failed to get a Withings access token!", err)
@@ -172,35 +350,59 @@ func withingsCallback(rw http.ResponseWriter, req *http.Request, s *state.State)
 		return // redirect was issued.
 	}
 
-	db.WithingsTokenSave(s.DB, user, token)
+	err = db.WithingsTokenSave(req.Context(), s.DB, s.TokenKeys, user, token)
+	if err != nil {
+		serverError(rw, "Failed to save Withings token", err)
+		return
+	}
+
+	// get told about new measurements as they happen:
+	err = withings.Subscribe(req.Context(), s.Withings, user.UserID)
+	if err != nil {
+		// not fatal, the scheduled sync still picks up new measurements
+		log.Printf("Failed to subscribe user %s to withings notifications: %s", user.UserID, err)
+	}
 
 	http.Redirect(rw, req, "/", http.StatusFound)
 
 }
 
-// Redirect user to the oauth login page for FatSecret
-func linkFatSecret(rw http.ResponseWriter, req *http.Request, s *state.State) {
+// Disconnect the user's Withings account
+func unlinkWithings(rw http.ResponseWriter, req *http.Request, s *state.State) {
 
-	client := fatsecret.NewClient()
+	if req.Method != "POST" {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-	requestToken, requestTokenSecret := client.OAuthClient.GetRequestToken(s.FatSecret.AuthCallbackURL)
-	session := getSession(s, req)
+	user, exists := getUser(rw, req, s)
+	if !exists {
+		return // redirect was issued.
+	}
 
-	session.Values[sessionRequestToken] = requestToken
-	session.Values[sessionRequestTokenSecret] = requestTokenSecret
-	err := session.Save(req, rw)
+	// revoke the subscription while we still have a token to authorize the request with
+	err := withings.Unsubscribe(req.Context(), s.Withings, user.UserID)
 	if err != nil {
-		panic(err)
+		// not fatal, notifications for an unlinked user are ignored
+		log.Printf("Failed to unsubscribe user %s from withings notifications: %s", user.UserID, err)
 	}
 
-	userAuthorizeURL := client.OAuthClient.GetAuthorizeURL(requestToken)
-	http.Redirect(rw, req, userAuthorizeURL, http.StatusSeeOther)
+	err = db.WithingsTokenDelete(req.Context(), s.DB, user)
+	if err != nil {
+		serverError(rw, "Failed to unlink Withings", err)
+		return
+	}
+
+	http.Redirect(rw, req, "/", http.StatusFound)
 }
 
-// To be called after user authorizes the app with the FatSecret API.
-func fatsecretCallback(rw http.ResponseWriter, req *http.Request, s *state.State) {
-	// sample url:
-	// http://localhost:8080/fatsecretCallback?oauth_token=a5d5e068b1f04b158df7dbc2fc4f8a2f&oauth_verifier=7009457
+// Save the unit the user wants weights displayed in
+func displayUnitHandler(rw http.ResponseWriter, req *http.Request, s *state.State) {
+
+	if req.Method != "POST" {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
 	err := req.ParseForm()
 	if err != nil {
@@ -210,66 +412,191 @@ func fatsecretCallback(rw http.ResponseWriter, req *http.Request, s *state.State
 		return
 	}
 
-	session := getSession(s, req)
-	requestToken := session.Values[sessionRequestToken].(string)
-	if requestToken == "" {
-		log.Fatal("Request token missing from session.")
+	unit, err := units.Parse(req.Form.Get("unit"))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	requestTokenSecret := session.Values[sessionRequestTokenSecret].(string)
-	if requestTokenSecret == "" {
-		log.Fatal("Request token secret missing from session.")
+	user, exists := getUser(rw, req, s)
+	if !exists {
+		return // redirect was issued.
 	}
 
-	// confirm token passed on callback is the same as the one from the session for sanity.
-	oauthToken := req.Form.Get("oauth_token")
-	if oauthToken == "" {
-		log.Fatal("Callback doesn't have a oauth token!?")
+	err = units.UserUnitSave(req.Context(), s.DB, user.UserID, unit)
+	if err != nil {
+		serverError(rw, "Failed to save display unit", err)
+		return
 	}
 
-	if requestToken != oauthToken {
-		log.Fatal("Request token values differ somehow.")
+	http.Redirect(rw, req, "/", http.StatusFound)
+}
+
+// Re-fetch the user's full Withings history on their next sync
+func withingsResync(rw http.ResponseWriter, req *http.Request, s *state.State) {
+
+	if req.Method != "POST" {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	verifierStr := req.Form.Get("oauth_verifier")
-	if verifierStr == "" {
-		log.Fatal("Missing oauth verifier")
+	user, exists := getUser(rw, req, s)
+	if !exists {
+		return // redirect was issued.
 	}
-	verifier, err := strconv.Atoi(verifierStr)
+
+	err := db.WithingsCursorReset(req.Context(), s.DB, user.UserID)
 	if err != nil {
-		panic(err)
+		serverError(rw, "Failed to reset Withings sync", err)
+		return
 	}
 
-	client := fatsecret.NewClient()
-	token, secret := client.OAuthClient.GetAccessToken(requestToken, requestTokenSecret, verifier)
+	http.Redirect(rw, req, "/", http.StatusFound)
+}
+
+// Receive Withings notifications of new measurements and queue a sync for just that user
+func withingsNotifyHandler(s *state.State) func(rw http.ResponseWriter, req *http.Request) {
 
-	log.Print("Saving token and redirecting")
+	return func(rw http.ResponseWriter, req *http.Request) {
+
+		// withings checks the callback URL responds before accepting a subscription
+		if req.Method == "GET" || req.Method == "HEAD" {
+			rw.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if req.Method != "POST" {
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		err := req.ParseForm()
+		if err != nil {
+			http.Error(rw, "Error parsing form values", http.StatusBadRequest)
+			return
+		}
+
+		userID := req.Form.Get(withings.NotifyUserParam)
+		signature := req.Form.Get(withings.NotifySignatureParam)
+		if userID == "" || !withings.VerifyNotifyCallback(s.Withings, userID, signature) {
+			log.Printf("Rejecting withings notification with bad signature for user %q", userID)
+			http.Error(rw, "Invalid notification", http.StatusForbidden)
+			return
+		}
+
+		log.Printf("Withings notification for user %s, appli %s", userID, req.Form.Get("appli"))
+		if !s.RequestSync(userID) {
+			log.Printf("Sync queue full, user %s will be synced on schedule", userID)
+		}
+
+		rw.WriteHeader(http.StatusOK)
+	}
+}
+
+// Redirect user to the oauth login page for FatSecret
+func linkFatSecret(rw http.ResponseWriter, req *http.Request, s *state.State) {
+
+	user, exists := getUser(rw, req, s)
+	if !exists {
+		return // redirect was issued.
+	}
+
+	flow := fatSecretFlow(s)
+
+	userAuthorizeURL, err := flow.Begin(rw, req)
+	if err != nil {
+		retryErrorPage(rw, s, "FatSecret couldn't be reached to link your account.", "/linkFatSecret", err)
+		return
+	}
+
+	log.Printf("Sending user %s to FatSecret for authorization", user.UserID)
+	http.Redirect(rw, req, userAuthorizeURL, http.StatusSeeOther)
+}
+
+// To be called after user authorizes the app with the FatSecret API.
+func fatsecretCallback(rw http.ResponseWriter, req *http.Request, s *state.State) {
+	// sample url:
+	// http://localhost:8080/fatsecretCallback?oauth_token=a5d5e068b1f04b158df7dbc2fc4f8a2f&oauth_verifier=7009457
 
 	user, exists := getUser(rw, req, s)
 	if !exists {
 		return // redirect was issued.
 	}
 
+	flow := fatSecretFlow(s)
+
+	token, secret, err := flow.Complete(rw, req)
+	if errors.Is(err, oauth1.ErrNoTemporaryCredentials) || errors.Is(err, oauth1.ErrExpired) ||
+		errors.Is(err, oauth1.ErrTokenMismatch) || errors.Is(err, oauth1.ErrMissingVerifier) {
+
+		log.Printf("Rejecting FatSecret callback for user %s: %s", user.UserID, err)
+		rw.WriteHeader(http.StatusBadRequest)
+		renderTemplate(rw, s, errorTemplate, errorPageData{
+			Message:  "Linking FatSecret wasn't finished in time or was denied, so your account was not linked.",
+			RetryURL: "/linkFatSecret",
+		})
+		return
+	}
+	if err != nil {
+		// the request token was used up, so the whole link has to be started over
+		retryErrorPage(rw, s, "FatSecret couldn't be reached to finish linking your account.", "/linkFatSecret",
+			err)
+		return
+	}
+
+	log.Print("Saving token and redirecting")
+
 	// save token
-	db.FatSecretTokenSave(s.DB, user, token, secret)
+	err = db.FatSecretTokenSave(req.Context(), s.DB, s.TokenKeys, user, token, secret)
+	if err != nil {
+		serverError(rw, "Failed to save FatSecret token", err)
+		return
+	}
 
 	http.Redirect(rw, req, "/", http.StatusFound)
 
 }
 
+// Disconnect the user's FatSecret account
+func unlinkFatSecret(rw http.ResponseWriter, req *http.Request, s *state.State) {
+
+	if req.Method != "POST" {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, exists := getUser(rw, req, s)
+	if !exists {
+		return // redirect was issued.
+	}
+
+	err := db.FatSecretTokenDelete(req.Context(), s.DB, user)
+	if err != nil {
+		serverError(rw, "Failed to unlink FatSecret", err)
+		return
+	}
 
-// get or initialize a user session using the unique user id value to key into the store.
-// this should only be called when the user id cookie is known to be set.
+	http.Redirect(rw, req, "/", http.StatusFound)
+}
+
+// get or initialize the user's session.  a session that can't be decoded (e.g. after the session key
+// changed) is replaced with a fresh one.
 func getSession(s *state.State, req *http.Request) *sessions.Session {
 
-	userId, _ := getUserId(req)
-	session, err := s.SessionStore.Get(req, userId)
+	session, err := s.SessionStore.Get(req, sessionName)
 	if err != nil {
-		panic(err)
+		log.Print("Discarding unreadable session: ", err)
 	}
 	return session
 }
 
+// log the user in by saving their id in the session
+func setSessionUserID(rw http.ResponseWriter, req *http.Request, s *state.State, userID string) error {
+
+	session := getSession(s, req)
+	session.Values[sessionUserID] = userID
+	return session.Save(req, rw)
+}
 
 // Wrap session related functionality common to other handlers.
 func sessionHandler(s *state.State,
@@ -281,10 +608,9 @@ func sessionHandler(s *state.State,
 
 		handlerName := FunctionGetShortName(handler)
 
-		// retrieve user id cookie - it's set in JS on the client side, so it must exist by now:
-		userId, err := getUserId(req)
-		if err == http.ErrNoCookie {
-			// no user id cookie present, redirect to the login page.
+		userId, err := getUserId(s, req)
+		if err != nil {
+			// not logged in, redirect to the login page.
 			http.Redirect(rw, req, "/login", http.StatusSeeOther)
 
 		} else {
@@ -296,15 +622,17 @@ func sessionHandler(s *state.State,
 	}
 }
 
-func getUserId(req *http.Request) (userId string, err error) {
+// errNotLoggedIn is returned when the session has no user id
+var errNotLoggedIn = errors.New("not logged in")
 
-	cookie, err := req.Cookie(userIDCookie)
-	if err == http.ErrNoCookie {
-		// no user id cookie present, redirect to the login page.
-		return "", err
+// get the id of the logged in user from their signed session
+func getUserId(s *state.State, req *http.Request) (userId string, err error) {
 
-	} else {
-		// we have a user ident, so proceed with session capable handlers
-		return cookie.Value, nil
+	session := getSession(s, req)
+	userId, ok := session.Values[sessionUserID].(string)
+	if !ok || userId == "" {
+		return "", errNotLoggedIn
 	}
-}
\ No newline at end of file
+
+	return userId, nil
+}
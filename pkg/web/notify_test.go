@@ -0,0 +1,108 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/bdelliott/wfsync/pkg/state"
+	"github.com/bdelliott/wfsync/pkg/withings"
+)
+
+// a server with just the notify endpoint, whose configured URL already has a query
+func newNotifyServer(t *testing.T) (*httptest.Server, *state.State, *withings.FakeNotifier) {
+
+	s := &state.State{SyncRequests: make(chan string, 1)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/withingsNotify", withingsNotifyHandler(s))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	notifier := withings.NewFakeNotifier()
+	s.Withings = withings.StateInit("key", "secret", server.URL+"/withingsCallback",
+		server.URL+"/withingsNotify?env=test", []byte("notify key"))
+	s.Withings.Notifier = notifier
+
+	return server, s, notifier
+}
+
+func TestWithingsNotify(t *testing.T) {
+
+	ctx := context.Background()
+	_, s, notifier := newNotifyServer(t)
+
+	err := withings.Subscribe(ctx, s.Withings, "u1")
+	if err != nil {
+		t.Fatalf("Subscribe: %s", err)
+	}
+
+	callbackURL, subscribed := notifier.Subscribed("u1")
+	if !subscribed {
+		t.Fatal("user not subscribed")
+	}
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		t.Fatalf("bad callback URL %q: %s", callbackURL, err)
+	}
+	query := u.Query()
+	if query.Get("env") != "test" || query.Get(withings.NotifyUserParam) != "u1" ||
+		query.Get(withings.NotifySignatureParam) == "" {
+		t.Errorf("callback URL %q doesn't keep the configured query and add the user and signature", callbackURL)
+	}
+
+	err = notifier.Notify(ctx, "u1")
+	if err != nil {
+		t.Fatalf("Notify: %s", err)
+	}
+
+	select {
+	case userID := <-s.SyncRequests:
+		if userID != "u1" {
+			t.Errorf("sync requested for %q, want u1", userID)
+		}
+	default:
+		t.Error("notification didn't request a sync")
+	}
+
+	err = withings.Unsubscribe(ctx, s.Withings, "u1")
+	if err != nil {
+		t.Fatalf("Unsubscribe: %s", err)
+	}
+	err = notifier.Notify(ctx, "u1")
+	if err == nil {
+		t.Error("notified a user after they unsubscribed")
+	}
+}
+
+func TestWithingsNotifyForged(t *testing.T) {
+
+	server, s, _ := newNotifyServer(t)
+
+	callbackURL, err := withings.NotifyCallbackURL(s.Withings, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := strings.Replace(callbackURL, "user=u1", "user=u2", 1)
+
+	for _, target := range []string{forged, server.URL + "/withingsNotify?user=u1"} {
+		resp, err := http.PostForm(target, url.Values{"appli": {"1"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: status %d, want %d", target, resp.StatusCode, http.StatusForbidden)
+		}
+	}
+
+	select {
+	case userID := <-s.SyncRequests:
+		t.Errorf("forged notification requested a sync for %q", userID)
+	default:
+	}
+}
@@ -0,0 +1,71 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/bdelliott/wfsync/pkg/db"
+	"github.com/bdelliott/wfsync/pkg/fatsecret"
+	"github.com/bdelliott/wfsync/pkg/oauth1"
+	"github.com/bdelliott/wfsync/pkg/state"
+)
+
+// requestTokenStore keeps the logged in user's oauth1 request tokens in the database, so the token secret
+// never reaches the browser
+type requestTokenStore struct {
+	s        *state.State
+	provider string
+}
+
+func (r requestTokenStore) Save(rw http.ResponseWriter, req *http.Request, creds oauth1.TemporaryCredentials) error {
+
+	userID, err := getUserId(r.s, req)
+	if err != nil {
+		return err
+	}
+
+	return db.OAuthRequestTokenSave(req.Context(), r.s.DB, userID, r.provider, creds.Token, creds.Secret,
+		creds.Expires)
+}
+
+func (r requestTokenStore) Get(req *http.Request) (oauth1.TemporaryCredentials, error) {
+
+	userID, err := getUserId(r.s, req)
+	if err != nil {
+		return oauth1.TemporaryCredentials{}, err
+	}
+
+	token, secret, expires, err := db.OAuthRequestTokenGet(req.Context(), r.s.DB, userID, r.provider)
+	if err == db.ErrNotFound {
+		return oauth1.TemporaryCredentials{}, oauth1.ErrNoTemporaryCredentials
+	}
+	if err != nil {
+		return oauth1.TemporaryCredentials{}, err
+	}
+
+	creds := oauth1.TemporaryCredentials{
+		Token:   token,
+		Secret:  secret,
+		Expires: expires,
+	}
+	return creds, nil
+}
+
+func (r requestTokenStore) Delete(rw http.ResponseWriter, req *http.Request) error {
+
+	userID, err := getUserId(r.s, req)
+	if err != nil {
+		return err
+	}
+
+	return db.OAuthRequestTokenDelete(req.Context(), r.s.DB, userID, r.provider)
+}
+
+// the flow linking a user's FatSecret account
+func fatSecretFlow(s *state.State) oauth1.Flow {
+
+	return oauth1.Flow{
+		Client:      fatsecret.NewClient(s.FatSecret).OAuthClient,
+		CallbackURL: s.FatSecret.AuthCallbackURL,
+		Store:       requestTokenStore{s: s, provider: db.SourceFatSecret},
+	}
+}
@@ -1,13 +1,19 @@
 package web
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"html/template"
 	"log"
 	"net/http"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"strings"
 
 	"github.com/bdelliott/wfsync/pkg/db"
+	"github.com/bdelliott/wfsync/pkg/oauth1"
 	"github.com/bdelliott/wfsync/pkg/state"
 )
 
@@ -19,20 +25,91 @@ func FunctionGetShortName(fn interface{}) string {
 	return shortHandlerName
 }
 
-// Get user information, or force a logout in the event of failure
+// Get user information, or send the user to log in if there's none.  If false is returned a response has
+// already been written.
 func getUser(rw http.ResponseWriter, req *http.Request, s *state.State) (db.User, bool) {
 
-	userId, err := getUserId(req)
+	userId, err := getUserId(s, req)
 	if err != nil {
-		log.Fatal("Error getting user cookie: ", err)
+		http.Redirect(rw, req, "/login", http.StatusSeeOther)
+		return db.User{}, false
 	}
 
-	user, exists := db.UserGet(s.DB, userId)
+	user, err := db.UserGet(req.Context(), s.DB, userId)
+	if err == db.ErrNotFound {
+		// user doesn't exist in the DB, e.g. the account was deleted from another browser.  drop the stale
+		// session rather than have every page fail until the cookie expires.
+		err = clearSession(rw, req, s)
+		if err != nil {
+			serverError(rw, "Failed to clear session", err)
+			return user, false
+		}
+		http.Redirect(rw, req, "/login", http.StatusSeeOther)
+		return user, false
+	}
+	if err != nil {
+		serverError(rw, "Failed to look up user", err)
+		return user, false
+	}
 
-	if !exists {
-		// user doesn't exist in the DB.  force a logout.
-		http.Redirect(rw, req, "/logout", http.StatusSeeOther)
+	return user, true
+}
+
+// Render a template from the asset dir, reporting any failure to the user as an internal server error
+func renderTemplate(rw http.ResponseWriter, s *state.State, templateFile string, data interface{}) {
+
+	t, err := template.ParseFiles(filepath.Join(s.Config.AssetDir, templateFile))
+	if err != nil {
+		serverError(rw, "Failed to parse template "+templateFile, err)
+		return
 	}
 
-	return user, exists
+	err = t.Execute(rw, data)
+	if err != nil {
+		log.Printf("Failed to execute template %s %s", templateFile, err)
+	}
+}
+
+// Log an unexpected error and report it to the user as an internal server error
+func serverError(rw http.ResponseWriter, msg string, err error) {
+	log.Printf("%s: %s", msg, err)
+	http.Error(rw, msg, http.StatusInternalServerError)
+}
+
+// Render the error page with a message the user can act on
+func errorPage(rw http.ResponseWriter, s *state.State, status int, msg string) {
+
+	rw.WriteHeader(status)
+	renderTemplate(rw, s, errorTemplate, errorPageData{Message: msg})
+}
+
+// Log a failed call to a linked service and render the error page with a link to try again.  The service's
+// own response is logged but not shown, it may be unhelpful or leak details.
+func retryErrorPage(rw http.ResponseWriter, s *state.State, msg string, retryURL string, err error) {
+	log.Printf("%s: %s", msg, err)
+
+	status := http.StatusBadGateway
+	var httpErr *oauth1.HTTPError
+	if errors.As(err, &httpErr) && httpErr.Temporary() {
+		status = http.StatusServiceUnavailable
+	}
+
+	rw.WriteHeader(status)
+	renderTemplate(rw, s, errorTemplate, errorPageData{Message: msg, RetryURL: retryURL})
+}
+
+// data for the error page
+type errorPageData struct {
+	Message  string
+	RetryURL string // where to send the user to try again, if anywhere
+}
+
+// hex encoding of size random bytes
+func randomHex(size int) (string, error) {
+	buf := make([]byte, size)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
 }
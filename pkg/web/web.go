@@ -1,47 +1,84 @@
 package web
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"time"
 
 	"github.com/bdelliott/wfsync/pkg/state"
-	"github.com/gorilla/context"
+	gcontext "github.com/gorilla/context"
+	"github.com/gorilla/csrf"
 )
 
 // Serve starts a little webapp for syncing Withings body scale measurements to
-// a FatSecret profile
-func Serve(s *state.State) {
+// a FatSecret profile.  The server is shut down when the context is cancelled.
+func Serve(ctx context.Context, s *state.State) {
 
 	// map url paths to handler functions:
+	mux := http.NewServeMux()
 
 	// static assets:
-	http.Handle("/js/", http.FileServer(http.Dir("./assets")))
-	http.Handle("/css/", http.FileServer(http.Dir("./assets")))
+	mux.Handle("/js/", http.FileServer(http.Dir(s.Config.AssetDir)))
+	mux.Handle("/css/", http.FileServer(http.Dir(s.Config.AssetDir)))
 
 	// home page:
-	http.HandleFunc("/", sessionHandler(s, home))
+	mux.HandleFunc("/", sessionHandler(s, home))
 
-	// login page
-	http.HandleFunc("/login/", loginHandler(s))
-	http.HandleFunc("/logout/", logoutHandler)
+	// login pages
+	mux.HandleFunc("/login", loginHandler(s))
+	mux.HandleFunc("/register", registerHandler(s))
+	mux.HandleFunc("/logout", logoutHandler(s))
 
 	// post-login handlers:
-	http.HandleFunc("/linkWithings", sessionHandler(s, linkWithings))
-	http.HandleFunc("/withingsCallback", sessionHandler(s, withingsCallback))
-	http.HandleFunc("/linkFatSecret", sessionHandler(s, linkFatSecret))
-	http.HandleFunc("/fatsecretCallback", sessionHandler(s, fatsecretCallback))
+	mux.HandleFunc("/linkWithings", sessionHandler(s, linkWithings))
+	mux.HandleFunc("/withingsCallback", sessionHandler(s, withingsCallback))
+	mux.HandleFunc("/withingsResync", sessionHandler(s, withingsResync))
+	mux.HandleFunc("/unlinkWithings", sessionHandler(s, unlinkWithings))
+	mux.HandleFunc("/linkFatSecret", sessionHandler(s, linkFatSecret))
+	mux.HandleFunc("/fatsecretCallback", sessionHandler(s, fatsecretCallback))
+	mux.HandleFunc("/unlinkFatSecret", sessionHandler(s, unlinkFatSecret))
+	mux.HandleFunc("/syncInterval", sessionHandler(s, syncIntervalHandler))
+	mux.HandleFunc("/displayUnit", sessionHandler(s, displayUnitHandler))
+	mux.HandleFunc("/reconcilePolicy", sessionHandler(s, reconcilePolicyHandler))
+	mux.HandleFunc("/export", sessionHandler(s, exportHandler))
+	mux.HandleFunc("/deleteAccount", sessionHandler(s, deleteAccountHandler))
+
+	// every form post needs a csrf token:
+	protect := csrf.Protect(s.CSRFKey,
+		csrf.Secure(s.SecureCookies),
+		csrf.Path("/"),
+		csrf.SameSite(csrf.SameSiteLaxMode),
+	)
+
+	root := http.NewServeMux()
+	root.Handle("/", protect(mux))
+
+	// called by withings, outside of any user session so there's no csrf token:
+	root.HandleFunc("/withingsNotify", withingsNotifyHandler(s))
 
 	//http.HandleFunc(authCallbackPath, authCallback(&State, &authCallbackUrl))
 
 	// start the http service:
 	srv := &http.Server{
-		Addr:           ":8080",
+		Addr:           s.Config.ListenAddr,
 		ReadTimeout:    10 * time.Second,
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
-		Handler:        context.ClearHandler(http.DefaultServeMux),
+		Handler:        gcontext.ClearHandler(root),
 	}
 
-	log.Fatal(srv.ListenAndServe())
+	go func() {
+		<-ctx.Done()
+		log.Print("Shutting down web server")
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	err := srv.ListenAndServe()
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 }
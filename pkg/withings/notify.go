@@ -0,0 +1,163 @@
+package withings
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const notifyURL = "https://api.health.nokia.com/notify"
+
+// notification category for weight and body composition measurements
+const notifyAppliWeight = "1"
+
+// callback query params identifying the user a notification is for
+const (
+	NotifyUserParam      = "user"
+	NotifySignatureParam = "sig"
+)
+
+// Notifier manages a user's subscription to notifications of new measurements.  Withings calls the
+// callback URL whenever the user has new data.
+type Notifier interface {
+	Subscribe(ctx context.Context, userID string, callbackURL string) error
+	Unsubscribe(ctx context.Context, userID string, callbackURL string) error
+}
+
+// APINotifier subscribes users through the Withings notify API
+type APINotifier struct {
+	state *State
+	sqlDB *sql.DB
+}
+
+// NewAPINotifier creates a notifier making requests with the users' saved tokens
+func NewAPINotifier(state *State, sqlDB *sql.DB) *APINotifier {
+	return &APINotifier{
+		state: state,
+		sqlDB: sqlDB,
+	}
+}
+
+// Subscribe asks Withings to call the callback URL when the user has new weight measurements
+func (n *APINotifier) Subscribe(ctx context.Context, userID string, callbackURL string) error {
+	return n.notifyRequest(ctx, userID, "subscribe", callbackURL)
+}
+
+// Unsubscribe revokes a subscription made with Subscribe
+func (n *APINotifier) Unsubscribe(ctx context.Context, userID string, callbackURL string) error {
+	return n.notifyRequest(ctx, userID, "revoke", callbackURL)
+}
+
+func (n *APINotifier) notifyRequest(ctx context.Context, userID string, action string, callbackURL string) error {
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	params := url.Values{}
+	params.Set("action", action)
+	params.Set("callbackurl", callbackURL)
+	params.Set("appli", notifyAppliWeight)
+	if action == "subscribe" {
+		params.Set("comment", "wfsync")
+	}
+
+	client := oauth2.NewClient(ctx, TokenSource(ctx, n.state, n.sqlDB, userID))
+
+	req, err := http.NewRequest("GET", notifyURL+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var notifyResponse struct {
+		Status int
+	}
+	err = json.Unmarshal(body, &notifyResponse)
+	if err != nil {
+		return err
+	}
+
+	if notifyResponse.Status != 0 {
+		return fmt.Errorf("withings notify %s failed with status %d", action, notifyResponse.Status)
+	}
+
+	log.Printf("Withings notify %s succeeded for user %s", action, userID)
+	return nil
+}
+
+// NotifyCallbackURL builds the URL Withings calls for the user's notifications.  The URL carries our user id
+// and a signature over it, since Withings doesn't sign its callbacks.  Any query already in the configured
+// notify URL is kept.
+func NotifyCallbackURL(state *State, userID string) (string, error) {
+
+	u, err := url.Parse(state.notifyURL)
+	if err != nil {
+		return "", fmt.Errorf("bad withings notify URL: %w", err)
+	}
+
+	params := u.Query()
+	params.Set(NotifyUserParam, userID)
+	params.Set(NotifySignatureParam, notifySignature(state, userID))
+	u.RawQuery = params.Encode()
+
+	return u.String(), nil
+}
+
+// VerifyNotifyCallback checks that a callback's signature matches the user id it claims to be for
+func VerifyNotifyCallback(state *State, userID string, signature string) bool {
+	expected := notifySignature(state, userID)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+func notifySignature(state *State, userID string) string {
+	mac := hmac.New(sha256.New, state.notifySecret)
+	mac.Write([]byte("withings-notify:" + userID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Subscribe subscribes the user to notifications, if notifications are enabled
+func Subscribe(ctx context.Context, state *State, userID string) error {
+	if state.Notifier == nil {
+		return nil
+	}
+
+	callbackURL, err := NotifyCallbackURL(state, userID)
+	if err != nil {
+		return err
+	}
+	return state.Notifier.Subscribe(ctx, userID, callbackURL)
+}
+
+// Unsubscribe removes the user's notification subscription, if notifications are enabled
+func Unsubscribe(ctx context.Context, state *State, userID string) error {
+	if state.Notifier == nil {
+		return nil
+	}
+
+	callbackURL, err := NotifyCallbackURL(state, userID)
+	if err != nil {
+		return err
+	}
+	return state.Notifier.Unsubscribe(ctx, userID, callbackURL)
+}
@@ -0,0 +1,83 @@
+package withings
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// FakeNotifier keeps subscriptions in memory instead of calling Withings, for tests and local development.
+// Notify plays the part of Withings by calling a user's callback URL.
+type FakeNotifier struct {
+	mu            sync.Mutex
+	subscriptions map[string]string // user id -> callback url
+}
+
+// NewFakeNotifier creates a notifier with no subscriptions
+func NewFakeNotifier() *FakeNotifier {
+	return &FakeNotifier{
+		subscriptions: make(map[string]string),
+	}
+}
+
+// Subscribe records the user's callback URL
+func (n *FakeNotifier) Subscribe(ctx context.Context, userID string, callbackURL string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	log.Printf("Fake withings subscribe for user %s: %s", userID, callbackURL)
+	n.subscriptions[userID] = callbackURL
+	return nil
+}
+
+// Unsubscribe forgets the user's callback URL
+func (n *FakeNotifier) Unsubscribe(ctx context.Context, userID string, callbackURL string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	log.Printf("Fake withings unsubscribe for user %s", userID)
+	delete(n.subscriptions, userID)
+	return nil
+}
+
+// Subscribed returns the user's callback URL, if they are subscribed
+func (n *FakeNotifier) Subscribed(userID string) (callbackURL string, subscribed bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	callbackURL, subscribed = n.subscriptions[userID]
+	return callbackURL, subscribed
+}
+
+// Notify posts a new measurement notification to the user's callback URL, the way Withings does
+func (n *FakeNotifier) Notify(ctx context.Context, userID string) error {
+
+	callbackURL, subscribed := n.Subscribed(userID)
+	if !subscribed {
+		return fmt.Errorf("user %s is not subscribed", userID)
+	}
+
+	form := url.Values{}
+	form.Set("appli", notifyAppliWeight)
+
+	req, err := http.NewRequest("POST", callbackURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("notify callback returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package withings
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/bdelliott/wfsync/pkg/db"
+	"golang.org/x/oauth2"
+)
+
+// savingTokenSource hands out a user's withings token, refreshing it when expired and writing the refreshed
+// token back to the db so a rotated refresh token is never lost.
+type savingTokenSource struct {
+	ctx    context.Context
+	state  *State
+	sqlDB  *sql.DB
+	userID string
+}
+
+// TokenSource returns a token source for the user that persists every refreshed token.  Refreshes for the
+// same user are serialized across all token sources.
+func TokenSource(ctx context.Context, state *State, sqlDB *sql.DB, userID string) oauth2.TokenSource {
+
+	ts := &savingTokenSource{
+		ctx:    ctx,
+		state:  state,
+		sqlDB:  sqlDB,
+		userID: userID,
+	}
+
+	// only come back to the db once the cached token expires
+	return oauth2.ReuseTokenSource(nil, ts)
+}
+
+func (ts *savingTokenSource) Token() (*oauth2.Token, error) {
+
+	lock := ts.state.userLock(ts.userID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// re-read under the lock: another caller may have refreshed (and rotated the refresh token) already
+	user := db.User{UserID: ts.userID}
+	saved, err := db.WithingsTokenGet(ts.ctx, ts.sqlDB, ts.state.TokenKeys, user)
+	if err == db.ErrNotFound {
+		return nil, errors.New("no withings token saved for user " + ts.userID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if saved.Valid() {
+		return saved, nil
+	}
+
+	token, err := ts.state.Oauth2Config.TokenSource(ts.ctx, saved).Token()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Print("Saving refreshed withings token for user: ", ts.userID)
+	err = db.WithingsTokenSave(ts.ctx, ts.sqlDB, ts.state.TokenKeys, user, token)
+	if err != nil {
+		// don't hand out a token whose refresh token we failed to keep
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// get the lock serializing token refreshes for a user
+func (state *State) userLock(userID string) *sync.Mutex {
+
+	state.userLocksMu.Lock()
+	defer state.userLocksMu.Unlock()
+
+	lock, exists := state.userLocks[userID]
+	if !exists {
+		lock = &sync.Mutex{}
+		state.userLocks[userID] = lock
+	}
+
+	return lock
+}
@@ -1,12 +1,13 @@
 package withings
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"math"
 	"net/url"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/bdelliott/wfsync/pkg/db"
@@ -20,7 +21,11 @@ import (
 )
 
 const code string = "code"
-const csrfToken string = "taco"
+
+// cap on the number of pages fetched in one call, in case the API keeps saying there's more
+const maxMeasurementPages = 100
+
+const measureURL = "https://api.health.nokia.com/measure?action=getmeas"
 
 // State holds state related to Withings API
 type State struct {
@@ -29,6 +34,19 @@ type State struct {
 	authCallbackURL string
 
 	Oauth2Config *oauth2.Config
+
+	measureURL string // the getmeas endpoint, a stand-in in tests
+
+	// encrypt and decrypt the users' saved tokens
+	TokenKeys *db.TokenKeys
+
+	// notifications of new measurements, nil when disabled
+	Notifier     Notifier
+	notifyURL    string // base URL of our notify callback endpoint
+	notifySecret []byte // signs user ids in notify callback URLs
+
+	userLocksMu sync.Mutex
+	userLocks   map[string]*sync.Mutex // serializes token refreshes per user id
 }
 
 // MeasurementResponse contains the json body response to a get measurement request
@@ -37,15 +55,37 @@ type MeasurementResponse struct {
 	Body   struct {
 		UpdateTime    int64
 		TimeZone      string
-		MeasureGroups []struct {
-			GroupID  int64     `json:"grpid"`
-			Attrib   int       `json:"attrib"`
-			Date     int64     `json:"date"`
-			Category int       `json:"category"`
-			DeviceID string    `json:"deviceid"`
-			Measures []Measure `json:"measures"`
-		} `json:"measuregrps"`
+		MeasureGroups []MeasureGroup `json:"measuregrps"`
+
+		// set when the history didn't fit in this response; pass Offset back to get the next page
+		More   moreFlag `json:"more"`
+		Offset int      `json:"offset"`
+	}
+}
+
+// MeasureGroup is a set of measurements taken at the same time
+type MeasureGroup struct {
+	GroupID  int64     `json:"grpid"`
+	Attrib   int       `json:"attrib"`
+	Date     int64     `json:"date"`
+	Category int       `json:"category"`
+	DeviceID string    `json:"deviceid"`
+	Measures []Measure `json:"measures"`
+}
+
+// the API has sent "more" both as 0/1 and as a boolean
+type moreFlag bool
+
+func (m *moreFlag) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case "1", "true":
+		*m = true
+	case "0", "false", "null":
+		*m = false
+	default:
+		return fmt.Errorf("unexpected value for more: %s", data)
 	}
+	return nil
 }
 
 // Measure represents a single measurement
@@ -81,27 +121,31 @@ func ExchangeToken(state *State, req *http.Request) (*oauth2.Token, error) {
 	return token, nil
 }
 
-// GetAuthorizationURL returns auth url
-func GetAuthorizationURL(state *State) string {
+// GetAuthorizationURL returns auth url.  oauthState is sent back to the callback unchanged and must be checked
+// there, so that a callback can't be forged to link someone else's Withings account.
+func GetAuthorizationURL(state *State, oauthState string) string {
 
-	return state.Oauth2Config.AuthCodeURL(csrfToken, oauth2.AccessTypeOffline)
+	return state.Oauth2Config.AuthCodeURL(oauthState, oauth2.AccessTypeOffline)
 }
 
 // GetMeasurements retrieve measurements from the Withings API
 // https://developer.health.nokia.com/oauth2/#tag/measure%2Fpaths%2Fhttps%3A~1~1api.health.nokia.com~1measure%3Faction%3Dgetmeas%2Fget
-func GetMeasurements(state *State, token *db.WithingsToken) (weights []db.Weight, err error) {
-
-	const measureURL = "https://api.health.nokia.com/measure?action=getmeas"
+// Any refreshed token is saved back to the db.
+//
+// Only measurements added or changed since cursor.LastUpdate are fetched, the user's full history when it's 0.
+// A long history is fetched over several calls: after maxMeasurementPages the measurements so far are
+// returned with a next cursor resuming where they stopped.  timeZone is the user's time zone as Withings
+// knows it, e.g. "Europe/Paris", empty if it didn't say.
+func GetMeasurements(ctx context.Context, state *State, sqlDB *sql.DB, userID string,
+	cursor db.WithingsCursor) (measurements []db.Measurement, timeZone string, next db.WithingsCursor, err error) {
 
 	// url params
-	const accessToken = "access_token"
-	const measurementType = "meastype"
 	const category = "category"
 	const startdate = "startdate"
 	const enddate = "enddate"
+	const lastupdate = "lastupdate"
 	const offsetParam = "offset"
 
-	const weightMeasurementType = "1"
 	const realMeasurement = "1"
 
 	const minuteSeconds = 60
@@ -110,40 +154,124 @@ func GetMeasurements(state *State, token *db.WithingsToken) (weights []db.Weight
 	const yearSeconds = daySeconds * 365
 
 	params := url.Values{}
-	params.Set(accessToken, token.Token.AccessToken)
-	params.Set(measurementType, string(weightMeasurementType))
+	// no meastype: ask for every type of measurement
 	params.Set(category, string(realMeasurement))
 
-	now := time.Now()
-	nowSeconds := now.Unix()
+	offset := cursor.ResumeOffset
+
+	if cursor.LastUpdate > 0 {
+		// incremental sync: only groups created or updated since the last sync
+		params.Set(lastupdate, fmt.Sprint(cursor.LastUpdate))
+	} else {
+		if cursor.ResumeEnd == 0 {
+			// a new full-history query, or one saved without its window: an offset only means something
+			// within the window it was paging through
+			nowSeconds := time.Now().Unix()
+			cursor.ResumeStart = nowSeconds - (yearSeconds * 10) // start 10 years ago.
+			cursor.ResumeEnd = nowSeconds
+			offset = 0
+		}
 
-	startSeconds := nowSeconds - (yearSeconds * 10) // start 10 years ago.
+		params.Set(startdate, fmt.Sprint(cursor.ResumeStart))
+		params.Set(enddate, fmt.Sprint(cursor.ResumeEnd))
+	}
 
-	startDate := fmt.Sprint(startSeconds)
-	params.Set(startdate, startDate)
+	// the access token is sent as a bearer header, refreshing it as needed
+	client := oauth2.NewClient(ctx, TokenSource(ctx, state, sqlDB, userID))
+
+	// keep requesting pages until the API says there are no more
+	measureGroups := make([]MeasureGroup, 0)
+	resuming := offset > 0
+	updateTime := cursor.PendingUpdate
+
+	for page := 0; ; page++ {
+		if page == maxMeasurementPages {
+			log.Printf("Withings history for user %s still incomplete after %d pages, continuing next sync",
+				userID, page)
+			next = db.WithingsCursor{
+				LastUpdate:    cursor.LastUpdate,
+				ResumeOffset:  offset,
+				ResumeStart:   cursor.ResumeStart,
+				ResumeEnd:     cursor.ResumeEnd,
+				PendingUpdate: updateTime,
+			}
+			return decodeMeasureGroups(measureGroups), timeZone, next, nil
+		}
 
-	endDate := fmt.Sprint(nowSeconds)
-	params.Set(enddate, endDate)
+		params.Set(offsetParam, strconv.Itoa(offset))
 
-	// offset appears to not really be implemented yet, despite appearing in the docs
-	offset := 0
-	params.Set(offsetParam, strconv.Itoa(offset))
+		measurementResponse, err := getMeasurementPage(ctx, client, state.measureURL+"&"+params.Encode())
+		if err != nil {
+			return nil, "", db.WithingsCursor{}, err
+		}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+		// the first page's update time covers the whole history, including anything changed while paging,
+		// so a resumed sync keeps the one from the page it started with
+		if page == 0 && !resuming {
+			updateTime = measurementResponse.Body.UpdateTime
+		}
+
+		if timeZone == "" {
+			timeZone = measurementResponse.Body.TimeZone
+		}
+
+		measureGroups = append(measureGroups, measurementResponse.Body.MeasureGroups...)
+
+		if !measurementResponse.Body.More {
+			break
+		}
+		offset = measurementResponse.Body.Offset
+	}
+
+	return decodeMeasureGroups(measureGroups), timeZone, db.WithingsCursor{LastUpdate: updateTime}, nil
+}
+
+// flatten measure groups into one measurement per measure.  a group holds everything captured in a single
+// weigh-in (weight, fat ratio, heart rate, ...), keyed by measure type.
+func decodeMeasureGroups(measureGroups []MeasureGroup) []db.Measurement {
+
+	measurements := make([]db.Measurement, 0)
+
+	for _, measureGroup := range measureGroups {
+		for _, m := range measureGroup.Measures {
+			measurement := db.Measurement{
+				Source:    db.SourceWithings,
+				GroupID:   measureGroup.GroupID,
+				Type:      db.MeasureType(m.Type),
+				Value:     int64(m.Value),
+				Unit:      m.Unit,
+				Timestamp: measureGroup.Date,
+			}
+			measurements = append(measurements, measurement)
+		}
+	}
 
-	client := state.Oauth2Config.Client(ctx, &token.Token)
+	return measurements
+}
+
+// fetch and decode a single page of measurements
+func getMeasurementPage(ctx context.Context, client *http.Client, url string) (*MeasurementResponse, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
 
-	url := measureURL + "&" + params.Encode()
 	log.Print(url)
 
-	resp, err := client.Get(url)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
 	if err != nil {
 		return nil, err
 	}
 
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
 
 	var measurementResponse MeasurementResponse
 	err = json.Unmarshal(body, &measurementResponse)
@@ -152,37 +280,18 @@ func GetMeasurements(state *State, token *db.WithingsToken) (weights []db.Weight
 		return nil, err
 	}
 
-	// convert response structure to a slice of weight values and timestamps:
-	weights = make([]db.Weight, 0)
-
-	for _, measureGroup := range measurementResponse.Body.MeasureGroups {
-		measures := measureGroup.Measures
-		if len(measures) != 1 {
-			panic("Didn't expect more than 1 measurement in the group.")
-		}
-
-		m := measures[0]
-		weightInPounds := measurementToPounds(m)
-		weight := db.Weight{
-			Weight:    weightInPounds,
-			Timestamp: measureGroup.Date,
-		}
-
-		weights = append(weights, weight)
+	if measurementResponse.Status != 0 {
+		return nil, fmt.Errorf("withings measurement request failed with status %d",
+			measurementResponse.Status)
 	}
 
-	return weights, nil
-}
-
-func measurementToPounds(m Measure) float64 {
-	// measurement is value * 10^unit --> yields kg value
-	measurementKg := float64(m.Value) * math.Pow10(m.Unit)
-	measurementLbs := measurementKg * 2.2
-	return measurementLbs
+	return &measurementResponse, nil
 }
 
-// StateInit initializes withings state information
-func StateInit(apiKey string, apiSecret string, authCallbackURL string) *State {
+// StateInit initializes withings state information.  notifyURL is the URL of the endpoint receiving
+// measurement notifications; the notifier is attached separately.
+func StateInit(apiKey string, apiSecret string, authCallbackURL string, notifyURL string,
+	notifySecret []byte) *State {
 
 	cfg := &oauth2.Config{
 		ClientID:     apiKey,
@@ -194,6 +303,10 @@ func StateInit(apiKey string, apiSecret string, authCallbackURL string) *State {
 
 	withings := &State{
 		Oauth2Config: cfg,
+		measureURL:   measureURL,
+		notifyURL:    notifyURL,
+		notifySecret: notifySecret,
+		userLocks:    make(map[string]*sync.Mutex),
 	}
 	return withings
 }
@@ -0,0 +1,181 @@
+package withings
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bdelliott/wfsync/pkg/db"
+	"golang.org/x/oauth2"
+)
+
+// state talking to a stand-in getmeas endpoint, and a db with a valid token for user u1
+func newMeasureState(t *testing.T, handler http.HandlerFunc) (*State, *sql.DB) {
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	state := StateInit("key", "secret", "", "", nil)
+	state.measureURL = server.URL + "/measure?action=getmeas"
+
+	ctx := context.Background()
+	sqlDB, err := db.Open(filepath.Join(t.TempDir(), "wfsync.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	err = db.Migrate(ctx, sqlDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sqlDB.Exec(`INSERT INTO users (userId, userName) VALUES ('u1', 'amy')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := &oauth2.Token{AccessToken: "access", Expiry: time.Now().Add(time.Hour)}
+	err = db.WithingsTokenSave(ctx, sqlDB, nil, db.User{UserID: "u1"}, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return state, sqlDB
+}
+
+// a page holding one weigh-in, its group id the offset it was asked for
+func writePage(rw http.ResponseWriter, offset int, more bool, updateTime int64) {
+	moreFlag := 0
+	if more {
+		moreFlag = 1
+	}
+	fmt.Fprintf(rw, `{"status": 0, "body": {"updatetime": %d, "timezone": "Europe/Paris",
+		"measuregrps": [{"grpid": %d, "date": %d, "category": 1,
+			"measures": [{"value": 80500, "type": 1, "unit": -3}]}],
+		"more": %d, "offset": %d}}`, updateTime, offset, 1697800000+offset, moreFlag, offset+1)
+}
+
+func TestGetMeasurementsPages(t *testing.T) {
+
+	var requests []url.Values
+	state, sqlDB := newMeasureState(t, func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer access" {
+			t.Errorf("Authorization %q, want the user's token", req.Header.Get("Authorization"))
+		}
+		query := req.URL.Query()
+		requests = append(requests, query)
+
+		offset, _ := strconv.Atoi(query.Get("offset"))
+		writePage(rw, offset, offset < 2, 500+int64(offset))
+	})
+
+	measurements, timeZone, next, err := GetMeasurements(context.Background(), state, sqlDB, "u1",
+		db.WithingsCursor{})
+	if err != nil {
+		t.Fatalf("GetMeasurements: %s", err)
+	}
+
+	if len(requests) != 3 {
+		t.Fatalf("%d pages requested, want 3", len(requests))
+	}
+	for i, query := range requests {
+		if query.Get("offset") != strconv.Itoa(i) || query.Get("startdate") != requests[0].Get("startdate") ||
+			query.Get("enddate") != requests[0].Get("enddate") || query.Get("startdate") == "" {
+			t.Errorf("page %d query %v doesn't page through the first page's window", i, query)
+		}
+	}
+
+	if len(measurements) != 3 || measurements[2].GroupID != 2 || measurements[2].Float() != 80.5 {
+		t.Errorf("measurements %+v, want one from each page", measurements)
+	}
+	if timeZone != "Europe/Paris" {
+		t.Errorf("time zone %q", timeZone)
+	}
+	if next != (db.WithingsCursor{LastUpdate: 500}) {
+		t.Errorf("next cursor %+v, want the first page's update time", next)
+	}
+}
+
+// a history longer than maxMeasurementPages is fetched over several syncs, resuming in the same window
+func TestGetMeasurementsResume(t *testing.T) {
+
+	var requests []url.Values
+	state, sqlDB := newMeasureState(t, func(rw http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		requests = append(requests, query)
+
+		offset, _ := strconv.Atoi(query.Get("offset"))
+		writePage(rw, offset, offset < maxMeasurementPages+1, 500+int64(offset))
+	})
+
+	ctx := context.Background()
+	measurements, _, next, err := GetMeasurements(ctx, state, sqlDB, "u1", db.WithingsCursor{})
+	if err != nil {
+		t.Fatalf("GetMeasurements: %s", err)
+	}
+
+	if len(requests) != maxMeasurementPages || len(measurements) != maxMeasurementPages {
+		t.Fatalf("%d pages requested and %d measurements, want %d", len(requests), len(measurements),
+			maxMeasurementPages)
+	}
+	start, _ := strconv.ParseInt(requests[0].Get("startdate"), 10, 64)
+	end, _ := strconv.ParseInt(requests[0].Get("enddate"), 10, 64)
+	want := db.WithingsCursor{ResumeOffset: maxMeasurementPages, ResumeStart: start, ResumeEnd: end,
+		PendingUpdate: 500}
+	if next != want {
+		t.Fatalf("next cursor %+v, want %+v", next, want)
+	}
+
+	// the window is kept however long it is until the next sync
+	requests = nil
+	measurements, _, next, err = GetMeasurements(ctx, state, sqlDB, "u1", next)
+	if err != nil {
+		t.Fatalf("resuming: %s", err)
+	}
+
+	if len(requests) != 2 || len(measurements) != 2 {
+		t.Fatalf("%d pages requested and %d measurements resuming, want 2", len(requests), len(measurements))
+	}
+	for _, query := range requests {
+		if query.Get("startdate") != strconv.FormatInt(start, 10) ||
+			query.Get("enddate") != strconv.FormatInt(end, 10) {
+			t.Errorf("resumed with query %v, want the saved window %d to %d", query, start, end)
+		}
+	}
+	if requests[0].Get("offset") != strconv.Itoa(maxMeasurementPages) {
+		t.Errorf("resumed from offset %s, want %d", requests[0].Get("offset"), maxMeasurementPages)
+	}
+	if next != (db.WithingsCursor{LastUpdate: 500}) {
+		t.Errorf("next cursor %+v, want the update time from the start of the history", next)
+	}
+}
+
+// a full-history cursor saved without its window starts the history over
+func TestGetMeasurementsResumeWithoutWindow(t *testing.T) {
+
+	var requests []url.Values
+	state, sqlDB := newMeasureState(t, func(rw http.ResponseWriter, req *http.Request) {
+		requests = append(requests, req.URL.Query())
+		writePage(rw, 0, false, 700)
+	})
+
+	_, _, next, err := GetMeasurements(context.Background(), state, sqlDB, "u1",
+		db.WithingsCursor{ResumeOffset: 40, PendingUpdate: 500})
+	if err != nil {
+		t.Fatalf("GetMeasurements: %s", err)
+	}
+
+	if len(requests) != 1 || requests[0].Get("offset") != "0" {
+		t.Errorf("requests %v, want the history from offset 0", requests)
+	}
+	if next != (db.WithingsCursor{LastUpdate: 700}) {
+		t.Errorf("next cursor %+v, want the new query's update time", next)
+	}
+}
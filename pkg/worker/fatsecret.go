@@ -0,0 +1,116 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"math"
+	"time"
+
+	"github.com/bdelliott/wfsync/pkg/db"
+	"github.com/bdelliott/wfsync/pkg/fatsecret"
+	"github.com/bdelliott/wfsync/pkg/state"
+)
+
+const (
+	// how many months back the first import of a user's FatSecret history goes
+	fatSecretHistoryMonths = 120
+	// the first import stops early after this many months in a row without a weight
+	fatSecretEmptyMonths = 12
+
+	// FatSecret weights are saved to 4 decimal places of a kg
+	fatSecretUnit = -4
+)
+
+// Copy the user's FatSecret weight history into the db, a month at a time.  The first sync walks back through
+// the user's history; later ones re-read the months since the last sync, to pick up entries made or edited
+// in FatSecret.
+func pullFatSecretWeights(ctx context.Context, s *state.State, userID string, client fatsecret.Client) error {
+
+	lastSync, err := db.FatSecretCursorGet(ctx, s.DB, userID)
+	if err != nil && err != db.ErrNotFound {
+		return err
+	}
+
+	now := time.Now().UTC()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	oldest := month.AddDate(0, -fatSecretHistoryMonths+1, 0)
+	if lastSync > 0 {
+		last := time.Unix(lastSync, 0).UTC()
+		oldest = time.Date(last.Year(), last.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	synced := month
+	emptyMonths := 0
+	for ; !month.Before(oldest); month = month.AddDate(0, -1, 0) {
+
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		weightMonth, err := client.WeightsGetMonth(ctx, month)
+		if err != nil {
+			return err
+		}
+
+		measurements := make([]db.Measurement, 0)
+		for _, day := range weightMonth.Days {
+			measurements = append(measurements, fatSecretMeasurement(day.Date, float64(day.WeightKg)))
+		}
+
+		start := weightMonth.FromDate.Time().Unix()
+		end := weightMonth.ToDate.Time().AddDate(0, 0, 1).Unix()
+		err = db.MeasurementsSyncRange(ctx, s.DB, userID, db.SourceFatSecret, start, end, measurements)
+		if err != nil {
+			return err
+		}
+
+		synced = month
+
+		if len(measurements) > 0 {
+			emptyMonths = 0
+			continue
+		}
+
+		emptyMonths++
+		if lastSync == 0 && emptyMonths == fatSecretEmptyMonths {
+			break
+		}
+	}
+
+	log.Printf("Synced FatSecret weight history for user %s back to %s", userID, synced.Format("2006-01"))
+	return db.FatSecretCursorSave(ctx, s.DB, userID, now.Unix())
+}
+
+// a FatSecret weight is saved as a measurement grouped by its day
+func fatSecretMeasurement(day fatsecret.Date, kg float64) db.Measurement {
+	return db.Measurement{
+		Source:    db.SourceFatSecret,
+		GroupID:   int64(day),
+		Type:      db.MeasureWeight,
+		Value:     int64(math.Round(kg * math.Pow10(-fatSecretUnit))),
+		Unit:      fatSecretUnit,
+		Timestamp: day.Time().Unix(),
+	}
+}
+
+// the local copy of the user's FatSecret weights, in kg by day
+func fatSecretWeightsByDay(ctx context.Context, s *state.State, userID string) (map[fatsecret.Date]float64, error) {
+
+	measurements, err := db.MeasurementsGet(ctx, s.DB, userID, db.SourceFatSecret, db.MeasureWeight)
+	if err != nil {
+		return nil, err
+	}
+
+	weights := make(map[fatsecret.Date]float64)
+	for _, m := range measurements {
+		weights[fatsecret.Date(m.GroupID)] = m.Float()
+	}
+	return weights, nil
+}
+
+// weights are pushed to FatSecret rounded to 10g
+func sameWeight(a float64, b float64) bool {
+	return math.Round(a*100) == math.Round(b*100)
+}
@@ -0,0 +1,357 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/bdelliott/wfsync/pkg/db"
+	"github.com/bdelliott/wfsync/pkg/fatsecret"
+	"github.com/bdelliott/wfsync/pkg/state"
+)
+
+// Policy decides which weight FatSecret gets for a day, since it keeps one weight a day while Withings may
+// have several weigh-ins.  Except for PolicyWithings, a weight entered or edited by hand in FatSecret is kept.
+type Policy string
+
+// Reconciliation policies
+const (
+	PolicyFirst    Policy = "first"    // the day's first weigh-in
+	PolicyLast     Policy = "last"     // the day's last weigh-in
+	PolicyMin      Policy = "min"      // the day's lowest weigh-in
+	PolicyAverage  Policy = "average"  // the average of the day's weigh-ins
+	PolicyWithings Policy = "withings" // the day's last weigh-in, overwriting recent edits made in FatSecret
+)
+
+// DefaultPolicy is used for users who haven't picked a policy
+const DefaultPolicy = PolicyLast
+
+const reconcilePolicySetting = "reconcilePolicy"
+
+// how many days back PolicyWithings overwrites FatSecret's weight on days without new weigh-ins
+const overwriteDays = 30
+
+// Policies are the policies a user may choose from
+var Policies = []Policy{PolicyFirst, PolicyLast, PolicyMin, PolicyAverage, PolicyWithings}
+
+var policyLabels = map[Policy]string{
+	PolicyFirst:    "First weigh-in of the day",
+	PolicyLast:     "Last weigh-in of the day",
+	PolicyMin:      "Lowest weigh-in of the day",
+	PolicyAverage:  "Average of the day's weigh-ins",
+	PolicyWithings: "Withings always wins",
+}
+
+// Label describes the policy for display
+func (p Policy) Label() string {
+	return policyLabels[p]
+}
+
+// the weight FatSecret should have for a day, from the day's weigh-ins in kg, oldest first
+func (p Policy) weight(kgs []float64) float64 {
+
+	switch p {
+	case PolicyFirst:
+		return kgs[0]
+
+	case PolicyMin:
+		min := kgs[0]
+		for _, kg := range kgs[1:] {
+			min = math.Min(min, kg)
+		}
+		return min
+
+	case PolicyAverage:
+		sum := 0.0
+		for _, kg := range kgs {
+			sum += kg
+		}
+		return sum / float64(len(kgs))
+
+	default: // PolicyLast, PolicyWithings
+		return kgs[len(kgs)-1]
+	}
+}
+
+// PolicyGet returns the user's reconciliation policy
+func PolicyGet(ctx context.Context, s *state.State, userID string) (Policy, error) {
+
+	value, err := db.UserSettingGet(ctx, s.DB, userID, reconcilePolicySetting)
+	if err == db.ErrNotFound {
+		return DefaultPolicy, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if _, ok := policyLabels[Policy(value)]; !ok {
+		log.Printf("Ignoring bad reconcile policy %q for user %s", value, userID)
+		return DefaultPolicy, nil
+	}
+
+	return Policy(value), nil
+}
+
+// ErrUnsupportedPolicy is returned when saving a policy that isn't one of Policies
+var ErrUnsupportedPolicy = errors.New("unsupported reconcile policy")
+
+// PolicySave saves the user's reconciliation policy, which must be one of Policies
+func PolicySave(ctx context.Context, s *state.State, userID string, policy Policy) error {
+
+	if _, ok := policyLabels[policy]; !ok {
+		return fmt.Errorf("%w: %s", ErrUnsupportedPolicy, policy)
+	}
+
+	return db.UserSettingSave(ctx, s.DB, userID, reconcilePolicySetting, string(policy))
+}
+
+// Disagreement is a day on which FatSecret has a different weight than the policy picks from Withings
+type Disagreement struct {
+	Date        time.Time
+	WithingsKg  float64
+	FatSecretKg float64
+	ManualEdit  bool // FatSecret's weight was entered there by hand, and the policy keeps it
+}
+
+// what's known about the user's days, for reconciling them
+type days struct {
+	policy    Policy
+	location  *time.Location               // the user's time zone, which decides the day of a weigh-in
+	withings  map[fatsecret.Date][]float64 // weigh-ins in kg, oldest first
+	fatSecret map[fatsecret.Date]float64   // the local copy of FatSecret's history
+	pushed    map[fatsecret.Date]float64   // what was last pushed to FatSecret
+}
+
+func loadDays(ctx context.Context, s *state.State, userID string) (*days, error) {
+
+	policy, err := PolicyGet(ctx, s, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	location, err := userLocation(ctx, s, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	measurements, err := db.MeasurementsGet(ctx, s.DB, userID, db.SourceWithings, db.MeasureWeight)
+	if err != nil {
+		return nil, err
+	}
+
+	withings := make(map[fatsecret.Date][]float64)
+	for _, m := range measurements {
+		day := dayOf(m.Timestamp, location)
+		withings[day] = append(withings[day], m.Float())
+	}
+
+	fatSecret, err := fatSecretWeightsByDay(ctx, s, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	dayPushes, err := db.FatSecretDayPushesGet(ctx, s.DB, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	pushed := make(map[fatsecret.Date]float64)
+	for day, weight := range dayPushes {
+		pushed[fatsecret.Date(day)] = weight.Kg()
+	}
+
+	d := &days{
+		policy:    policy,
+		location:  location,
+		withings:  withings,
+		fatSecret: fatSecret,
+		pushed:    pushed,
+	}
+	return d, nil
+}
+
+// whether FatSecret's weight for the day was entered or edited there by hand: it's neither what was last
+// pushed nor one of the day's weigh-ins (which older versions pushed without recording it per day)
+func (d *days) manualEdit(day fatsecret.Date) bool {
+
+	fatSecretKg, ok := d.fatSecret[day]
+	if !ok {
+		return false
+	}
+
+	if pushedKg, ok := d.pushed[day]; ok && sameWeight(pushedKg, fatSecretKg) {
+		return false
+	}
+
+	for _, kg := range d.withings[day] {
+		if sameWeight(kg, fatSecretKg) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// the weight to push for the day, false if FatSecret should be left as is
+func (d *days) push(day fatsecret.Date) (float64, bool) {
+
+	kg := d.policy.weight(d.withings[day])
+
+	if fatSecretKg, ok := d.fatSecret[day]; ok && sameWeight(fatSecretKg, kg) {
+		return kg, false
+	}
+
+	if d.policy != PolicyWithings && d.manualEdit(day) {
+		return kg, false
+	}
+
+	return kg, true
+}
+
+// Reconcile the days with new Withings weigh-ins with FatSecret, oldest first.  Weigh-ins from before the
+// user linked FatSecret are recorded as done without being pushed.  With PolicyWithings, the days of the last
+// overwriteDays that FatSecret has a different weight for are overwritten too; days it has no weight for, and
+// older days, are left alone.  A day FatSecret rejects the date of is skipped.
+func reconcileWeights(ctx context.Context, s *state.State, userID string, client fatsecret.Client,
+	weightType string) error {
+
+	unpushed, err := db.WeightsUnpushed(ctx, s.DB, userID)
+	if err != nil {
+		return err
+	}
+
+	d, err := loadDays(ctx, s, userID)
+	if err != nil {
+		return err
+	}
+
+	// only weigh-ins from after FatSecret was linked are pushed, not the user's whole history
+	linkedAt, err := db.FatSecretLinkedAt(ctx, s.DB, userID)
+	if err != nil {
+		return err
+	}
+
+	newWeighIns := make(map[fatsecret.Date][]db.Weight)
+	for _, weight := range unpushed {
+		if weight.Timestamp < linkedAt {
+			err = db.WeightPushedSave(ctx, s.DB, userID, weight)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		day := dayOf(weight.Timestamp, d.location)
+		newWeighIns[day] = append(newWeighIns[day], weight)
+	}
+
+	// a pass re-checks recent days only, rather than the user's whole history
+	recent := fatsecret.DateOf(time.Now().In(d.location)) - overwriteDays
+
+	todo := make([]fatsecret.Date, 0)
+	for day := range d.withings {
+		_, isNew := newWeighIns[day]
+		_, inFatSecret := d.fatSecret[day]
+		_, overwrite := d.push(day)
+		if isNew || (d.policy == PolicyWithings && inFatSecret && overwrite && day >= recent) {
+			todo = append(todo, day)
+		}
+	}
+	sort.Slice(todo, func(i, j int) bool { return todo[i] < todo[j] })
+
+	for _, day := range todo {
+		err = reconcileDay(ctx, s, userID, client, weightType, d, day)
+		if errors.Is(err, fatsecret.ErrWeightDateEarly) || errors.Is(err, fatsecret.ErrWeightDateLate) {
+			// FatSecret won't ever take a weight for this day, so don't let it hold up the days after it
+			log.Printf("Skipping day %s for user %s: %s", day.Time().Format("2006-01-02"), userID, err)
+		} else if err != nil {
+			// leave the rest unpushed, they'll be retried on the next pass
+			return err
+		}
+
+		for _, weight := range newWeighIns[day] {
+			err = db.WeightPushedSave(ctx, s.DB, userID, weight)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Push the day's weight to FatSecret if the policy says to
+func reconcileDay(ctx context.Context, s *state.State, userID string, client fatsecret.Client, weightType string,
+	d *days, day fatsecret.Date) error {
+
+	kg, push := d.push(day)
+	if !push {
+		if d.manualEdit(day) {
+			log.Printf("Keeping weight edited in FatSecret for user %s on %s", userID,
+				day.Time().Format("2006-01-02"))
+		}
+		return nil
+	}
+
+	err := client.WeightUpdate(ctx, kg, day.Time(), weightType)
+	if err != nil {
+		return fmt.Errorf("failed to push weight to FatSecret: %w", err)
+	}
+
+	err = db.FatSecretDayPushSave(ctx, s.DB, userID, int64(day), pushedWeight(kg))
+	if err != nil {
+		return err
+	}
+
+	// keep the local copy of FatSecret's history in step
+	return db.MeasurementsSync(ctx, s.DB, userID, []db.Measurement{fatSecretMeasurement(day, kg)})
+}
+
+// a pushed weight as recorded for its day, rounded as it was sent
+func pushedWeight(kg float64) db.Weight {
+	return db.Weight{
+		Value: int64(math.Round(kg * 100)),
+		Unit:  -2,
+	}
+}
+
+// Disagreements lists the most recent days on which FatSecret's weight differs from the one the user's policy
+// picks from Withings, newest first
+func Disagreements(ctx context.Context, s *state.State, userID string, limit int) ([]Disagreement, error) {
+
+	d, err := loadDays(ctx, s, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	disagreements := make([]Disagreement, 0)
+	for day, fatSecretKg := range d.fatSecret {
+		kgs, ok := d.withings[day]
+		if !ok {
+			continue
+		}
+
+		withingsKg := d.policy.weight(kgs)
+		if !sameWeight(withingsKg, fatSecretKg) {
+			disagreements = append(disagreements, Disagreement{
+				Date:        day.Time(),
+				WithingsKg:  withingsKg,
+				FatSecretKg: fatSecretKg,
+				ManualEdit:  d.manualEdit(day),
+			})
+		}
+	}
+
+	sort.Slice(disagreements, func(i, j int) bool {
+		return disagreements[i].Date.After(disagreements[j].Date)
+	})
+
+	if len(disagreements) > limit {
+		disagreements = disagreements[:limit]
+	}
+	return disagreements, nil
+}
@@ -0,0 +1,402 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bdelliott/wfsync/pkg/db"
+	"github.com/bdelliott/wfsync/pkg/fatsecret"
+	"github.com/bdelliott/wfsync/pkg/state"
+)
+
+func TestPolicyWeight(t *testing.T) {
+
+	weighIns := []float64{80.4, 79.9, 80.2}
+
+	tests := []struct {
+		policy Policy
+		kgs    []float64
+		want   float64
+	}{
+		{PolicyFirst, weighIns, 80.4},
+		{PolicyLast, weighIns, 80.2},
+		{PolicyMin, weighIns, 79.9},
+		{PolicyAverage, weighIns, 80.1666666},
+		{PolicyWithings, weighIns, 80.2},
+		{PolicyFirst, []float64{81}, 81},
+		{PolicyLast, []float64{81}, 81},
+		{PolicyMin, []float64{81}, 81},
+		{PolicyAverage, []float64{81}, 81},
+		{PolicyWithings, []float64{81}, 81},
+	}
+
+	for _, tt := range tests {
+		got := tt.policy.weight(tt.kgs)
+		if math.Abs(got-tt.want) > 1e-6 {
+			t.Errorf("%s of %v = %v, want %v", tt.policy, tt.kgs, got, tt.want)
+		}
+	}
+}
+
+func TestManualEdit(t *testing.T) {
+
+	const day = fatsecret.Date(19650)
+
+	tests := []struct {
+		name      string
+		withings  []float64
+		fatSecret float64 // 0 for no weight in FatSecret
+		pushed    float64 // 0 for nothing pushed
+		want      bool
+	}{
+		{"no weight in FatSecret", []float64{80.4}, 0, 0, false},
+		{"the weight pushed", []float64{80.4, 80.2}, 80.2, 80.2, false},
+		{"pushed, rounded to FatSecret's precision", []float64{80.123}, 80.1234, 80.12, false},
+		{"one of the weigh-ins, pushed by an older version", []float64{80.4, 80.2}, 80.4, 0, false},
+		{"a weigh-in, though another was pushed since", []float64{80.4, 80.2}, 80.4, 80.2, false},
+		{"entered by hand", []float64{80.4, 80.2}, 78, 80.2, true},
+		{"entered by hand, nothing pushed", []float64{80.4}, 78, 0, true},
+		{"entered by hand, no weigh-ins", nil, 78, 0, true},
+	}
+
+	for _, tt := range tests {
+		d := &days{
+			withings:  map[fatsecret.Date][]float64{},
+			fatSecret: map[fatsecret.Date]float64{},
+			pushed:    map[fatsecret.Date]float64{},
+		}
+		if tt.withings != nil {
+			d.withings[day] = tt.withings
+		}
+		if tt.fatSecret != 0 {
+			d.fatSecret[day] = tt.fatSecret
+		}
+		if tt.pushed != 0 {
+			d.pushed[day] = tt.pushed
+		}
+
+		got := d.manualEdit(day)
+		if got != tt.want {
+			t.Errorf("%s: manualEdit = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPush(t *testing.T) {
+
+	const day = fatsecret.Date(19650)
+
+	tests := []struct {
+		name      string
+		policy    Policy
+		fatSecret float64 // 0 for no weight in FatSecret
+		wantKg    float64
+		wantPush  bool
+	}{
+		{"new day", PolicyLast, 0, 80.2, true},
+		{"already in FatSecret", PolicyLast, 80.2, 80.2, false},
+		{"pushed, then another weigh-in", PolicyLast, 80.4, 80.2, true},
+		{"edited by hand is kept", PolicyMin, 78, 80.2, false},
+		{"edited by hand is overwritten", PolicyWithings, 78, 80.2, true},
+	}
+
+	for _, tt := range tests {
+		d := &days{
+			policy:    tt.policy,
+			withings:  map[fatsecret.Date][]float64{day: {80.4, 80.2}},
+			fatSecret: map[fatsecret.Date]float64{},
+			pushed:    map[fatsecret.Date]float64{day: 80.4},
+		}
+		if tt.fatSecret != 0 {
+			d.fatSecret[day] = tt.fatSecret
+		}
+
+		kg, push := d.push(day)
+		if kg != tt.wantKg || push != tt.wantPush {
+			t.Errorf("%s: push = %v, %t, want %v, %t", tt.name, kg, push, tt.wantKg, tt.wantPush)
+		}
+	}
+}
+
+func TestDayOf(t *testing.T) {
+
+	newYork := time.FixedZone("EST", -5*60*60)
+	sydney := time.FixedZone("AEST", 10*60*60)
+
+	oct20 := fatsecret.DateOf(time.Date(2023, 10, 20, 0, 0, 0, 0, time.UTC))
+
+	tests := []struct {
+		name     string
+		weighIn  time.Time
+		location *time.Location
+		want     fatsecret.Date
+	}{
+		{"evening in New York, next day in UTC", time.Date(2023, 10, 20, 21, 30, 0, 0, newYork), newYork, oct20},
+		{"morning in Sydney, previous day in UTC", time.Date(2023, 10, 20, 7, 0, 0, 0, sydney), sydney, oct20},
+		{"UTC", time.Date(2023, 10, 20, 23, 59, 59, 0, time.UTC), time.UTC, oct20},
+		{"just past midnight", time.Date(2023, 10, 21, 0, 0, 1, 0, newYork), newYork, oct20 + 1},
+	}
+
+	for _, tt := range tests {
+		got := dayOf(tt.weighIn.Unix(), tt.location)
+		if got != tt.want {
+			t.Errorf("%s: day %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// state with a migrated db holding one user, who linked FatSecret before any of their weigh-ins
+func newTestState(t *testing.T) *state.State {
+
+	sqlDB, err := db.Open(filepath.Join(t.TempDir(), "wfsync.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	err = db.Migrate(context.Background(), sqlDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = sqlDB.Exec(`INSERT INTO users (userId, userName) VALUES ('u1', 'amy');
+		INSERT INTO fatsecretTokens (userId, token, secret, linkedAt) VALUES ('u1', 'token', 'secret', 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &state.State{DB: sqlDB}
+}
+
+// a weigh-in at noon UTC on the day
+func weighIn(day fatsecret.Date, kg float64) db.Measurement {
+	timestamp := day.Time().Unix() + 12*60*60
+	return db.Measurement{
+		Source:    db.SourceWithings,
+		GroupID:   timestamp,
+		Type:      db.MeasureWeight,
+		Value:     int64(math.Round(kg * 100)),
+		Unit:      -2,
+		Timestamp: timestamp,
+	}
+}
+
+// a client for a stand-in FatSecret API that records the days pushed to it, and rejects the days in rejected
+// with errorCode
+func newFakeFatSecret(t *testing.T, rejected map[fatsecret.Date]bool, errorCode int) (fatsecret.Client,
+	*[]fatsecret.Date) {
+
+	pushed := make([]fatsecret.Date, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("method") != "weight.update" {
+			t.Errorf("unexpected call of %s", req.URL.Query().Get("method"))
+			return
+		}
+
+		date, err := strconv.ParseInt(req.URL.Query().Get("date"), 10, 64)
+		if err != nil {
+			t.Errorf("bad date: %s", err)
+			return
+		}
+
+		day := fatsecret.Date(date)
+		if rejected[day] {
+			fmt.Fprintf(rw, `{"error": {"code": %d, "message": "rejected"}}`, errorCode)
+			return
+		}
+		pushed = append(pushed, day)
+		rw.Write([]byte(`{"success": {"value": "1"}}`))
+	}))
+	t.Cleanup(server.Close)
+
+	client := fatsecret.NewUserClient(fatsecret.StateInit("key", "secret", ""), "token", "token secret")
+	client.OAuthClient.Provider.RequestURL = server.URL
+	return client, &pushed
+}
+
+// a day FatSecret won't take a weight for doesn't hold up the days after it
+func TestReconcileSkipsRejectedDay(t *testing.T) {
+
+	ctx := context.Background()
+	today := fatsecret.DateOf(time.Now().UTC())
+	oldest, older, newest := today-3, today-2, today-1
+
+	for _, errorCode := range []int{205, 206} {
+		s := newTestState(t)
+		err := db.MeasurementsSync(ctx, s.DB, "u1",
+			[]db.Measurement{weighIn(oldest, 80), weighIn(older, 80.2), weighIn(newest, 80.4)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client, pushed := newFakeFatSecret(t, map[fatsecret.Date]bool{oldest: true}, errorCode)
+		err = reconcileWeights(ctx, s, "u1", client, fatsecret.WeightTypeKg)
+		if err != nil {
+			t.Fatalf("error %d: reconcileWeights: %s", errorCode, err)
+		}
+
+		if len(*pushed) != 2 || (*pushed)[0] != older || (*pushed)[1] != newest {
+			t.Errorf("error %d: pushed days %v, want %v", errorCode, *pushed, []fatsecret.Date{older, newest})
+		}
+
+		unpushed, err := db.WeightsUnpushed(ctx, s.DB, "u1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(unpushed) != 0 {
+			t.Errorf("error %d: weigh-ins left to push %+v", errorCode, unpushed)
+		}
+	}
+}
+
+// other errors stop the pass, leaving the day and the ones after it for the next
+func TestReconcileStopsOnError(t *testing.T) {
+
+	ctx := context.Background()
+	today := fatsecret.DateOf(time.Now().UTC())
+
+	s := newTestState(t)
+	err := db.MeasurementsSync(ctx, s.DB, "u1", []db.Measurement{weighIn(today-2, 80), weighIn(today-1, 80.2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, pushed := newFakeFatSecret(t, map[fatsecret.Date]bool{today - 2: true}, 9)
+	err = reconcileWeights(ctx, s, "u1", client, fatsecret.WeightTypeKg)
+	if !errors.Is(err, fatsecret.ErrInvalidToken) {
+		t.Errorf("got error %v, want %v", err, fatsecret.ErrInvalidToken)
+	}
+
+	unpushed, err := db.WeightsUnpushed(ctx, s.DB, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*pushed) != 0 || len(unpushed) != 2 {
+		t.Errorf("pushed %v, left %d weigh-ins to push, want none pushed and 2 left", *pushed, len(unpushed))
+	}
+}
+
+// PolicyWithings overwrites recent days FatSecret disagrees on, but doesn't re-push the whole history
+func TestReconcileOverwriteRecent(t *testing.T) {
+
+	ctx := context.Background()
+	today := fatsecret.DateOf(time.Now().UTC())
+	recent, old := today-overwriteDays+1, today-overwriteDays-1
+
+	s := newTestState(t)
+	err := PolicySave(ctx, s, "u1", PolicyWithings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.MeasurementsSync(ctx, s.DB, "u1", []db.Measurement{
+		weighIn(old, 80), weighIn(recent, 80),
+		fatSecretMeasurement(old, 78), fatSecretMeasurement(recent, 78),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the weigh-ins were pushed on an earlier pass
+	unpushed, err := db.WeightsUnpushed(ctx, s.DB, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, weight := range unpushed {
+		err = db.WeightPushedSave(ctx, s.DB, "u1", weight)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client, pushed := newFakeFatSecret(t, nil, 0)
+	err = reconcileWeights(ctx, s, "u1", client, fatsecret.WeightTypeKg)
+	if err != nil {
+		t.Fatalf("reconcileWeights: %s", err)
+	}
+
+	if len(*pushed) != 1 || (*pushed)[0] != recent {
+		t.Errorf("pushed days %v, want just %d", *pushed, recent)
+	}
+}
+
+// only weigh-ins from after FatSecret was linked are pushed, even when the Withings history is imported later
+func TestReconcileSkipsHistory(t *testing.T) {
+
+	ctx := context.Background()
+	today := fatsecret.DateOf(time.Now().UTC())
+
+	s := newTestState(t)
+	_, err := s.DB.Exec("UPDATE fatsecretTokens SET linkedAt=? WHERE userId='u1'", (today - 2).Time().Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.MeasurementsSync(ctx, s.DB, "u1",
+		[]db.Measurement{weighIn(today-5, 80), weighIn(today-4, 80.2), weighIn(today-1, 80.4)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, pushed := newFakeFatSecret(t, nil, 0)
+	err = reconcileWeights(ctx, s, "u1", client, fatsecret.WeightTypeKg)
+	if err != nil {
+		t.Fatalf("reconcileWeights: %s", err)
+	}
+
+	if len(*pushed) != 1 || (*pushed)[0] != today-1 {
+		t.Errorf("pushed days %v, want just %d", *pushed, today-1)
+	}
+
+	unpushed, err := db.WeightsUnpushed(ctx, s.DB, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unpushed) != 0 {
+		t.Errorf("weigh-ins left to push %+v", unpushed)
+	}
+}
+
+// weights are sent in the unit the user's FatSecret profile has, so pushing doesn't change it
+func TestPushWeightsKeepsProfileUnit(t *testing.T) {
+
+	ctx := context.Background()
+	s := newTestState(t)
+	err := db.MeasurementsSync(ctx, s.DB, "u1", []db.Measurement{weighIn(fatsecret.DateOf(time.Now().UTC()), 80)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	weightTypes := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Query().Get("method") {
+		case "profile.get":
+			rw.Write([]byte(`{"profile": {"weight_measure": "Lb", "height_measure": "Inch"}}`))
+		case "weight.update":
+			weightTypes = append(weightTypes, req.URL.Query().Get("weight_type"))
+			rw.Write([]byte(`{"success": {"value": "1"}}`))
+		default:
+			t.Errorf("unexpected call of %s", req.URL.Query().Get("method"))
+		}
+	}))
+	defer server.Close()
+
+	client := fatsecret.NewUserClient(fatsecret.StateInit("key", "secret", ""), "token", "token secret")
+	client.OAuthClient.Provider.RequestURL = server.URL
+
+	err = pushWeights(ctx, s, "u1", client)
+	if err != nil {
+		t.Fatalf("pushWeights: %s", err)
+	}
+
+	if len(weightTypes) != 1 || weightTypes[0] != fatsecret.WeightTypeLb {
+		t.Errorf("pushed with weight types %v, want the profile's %s", weightTypes, fatsecret.WeightTypeLb)
+	}
+}
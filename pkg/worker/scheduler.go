@@ -0,0 +1,216 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/bdelliott/wfsync/pkg/db"
+	"github.com/bdelliott/wfsync/pkg/state"
+)
+
+const (
+	// how often the scheduler wakes up to look for users that are due
+	pollInterval = time.Minute
+
+	// sync times are spread by up to +/- this fraction of the interval
+	jitterFraction = 0.1
+
+	// a failed sync is retried after this delay, doubling with each consecutive failure up to the user's
+	// sync interval
+	retryDelay = 5 * time.Minute
+
+	syncIntervalSetting = "syncInterval"
+)
+
+// SyncIntervals are the sync intervals a user may choose from
+var SyncIntervals = []time.Duration{
+	time.Hour,
+	3 * time.Hour,
+	6 * time.Hour,
+	12 * time.Hour,
+	24 * time.Hour,
+}
+
+// Scheduler periodically syncs every user with a linked Withings account
+type Scheduler struct {
+	state    *state.State
+	nextSync map[string]time.Time // user id -> time of next sync
+	failures map[string]int       // user id -> number of consecutive failed syncs
+}
+
+// NewScheduler creates a scheduler for all linked users
+func NewScheduler(s *state.State) *Scheduler {
+	return &Scheduler{
+		state:    s,
+		nextSync: make(map[string]time.Time),
+		failures: make(map[string]int),
+	}
+}
+
+// Run syncs users as they come due, and users queued with State.RequestSync right away, until the context
+// is cancelled
+func (sc *Scheduler) Run(ctx context.Context) {
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	sc.syncDue(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Print("Stopping sync scheduler: ", ctx.Err())
+			return
+		case userID := <-sc.state.SyncRequests:
+			sc.syncRequested(ctx, userID)
+		case <-ticker.C:
+			sc.syncDue(ctx)
+		}
+	}
+}
+
+// sync a single user out of schedule
+func (sc *Scheduler) syncRequested(ctx context.Context, userID string) {
+
+	user := db.User{UserID: userID}
+	token, err := db.WithingsTokenGet(ctx, sc.state.DB, sc.state.TokenKeys, user)
+	if err == db.ErrNotFound {
+		log.Printf("Ignoring sync request for user %s without a withings token", userID)
+		return
+	}
+	if err != nil {
+		// the user's regular sync will retry
+		log.Printf("Failed to read withings token for user %s: %s", userID, err)
+		return
+	}
+
+	withingsToken := db.WithingsToken{
+		UserID: userID,
+		Token:  *token,
+	}
+	sc.syncUser(ctx, &withingsToken)
+}
+
+// sync a user and schedule their next sync, or a retry if the sync failed
+func (sc *Scheduler) syncUser(ctx context.Context, withingsToken *db.WithingsToken) {
+
+	userID := withingsToken.UserID
+
+	interval, err := SyncIntervalGet(ctx, sc.state, userID)
+	if err != nil {
+		log.Printf("Failed to read sync interval for user %s: %s", userID, err)
+		interval = sc.state.Config.DefaultSyncInterval
+	}
+
+	err = SyncUser(ctx, sc.state, withingsToken)
+	if err != nil {
+		sc.failures[userID]++
+
+		delay := retryDelay << uint(sc.failures[userID]-1)
+		if delay <= 0 || delay > interval {
+			delay = interval
+		}
+
+		log.Printf("Failed to sync user %s (attempt %d), retrying in %s: %s", userID, sc.failures[userID],
+			delay, err)
+		sc.nextSync[userID] = time.Now().Add(delay)
+		return
+	}
+
+	delete(sc.failures, userID)
+	sc.nextSync[userID] = time.Now().Add(jitter(interval))
+}
+
+// sync every user whose next sync time has passed.  tokens are re-read on each pass so newly linked users
+// are picked up without a restart.
+func (sc *Scheduler) syncDue(ctx context.Context) {
+
+	linked := make(map[string]bool)
+
+	withingsTokens, err := db.WithingsTokensGetAll(ctx, sc.state.DB, sc.state.TokenKeys)
+	if err != nil {
+		// try again on the next tick
+		log.Print("Failed to read withings tokens: ", err)
+		return
+	}
+
+	for _, withingsToken := range withingsTokens {
+		if ctx.Err() != nil {
+			return
+		}
+
+		userID := withingsToken.UserID
+		linked[userID] = true
+
+		next, scheduled := sc.nextSync[userID]
+		if scheduled && time.Now().Before(next) {
+			continue
+		}
+
+		sc.syncUser(ctx, &withingsToken)
+	}
+
+	// forget users who are no longer linked
+	for userID := range sc.nextSync {
+		if !linked[userID] {
+			delete(sc.nextSync, userID)
+			delete(sc.failures, userID)
+		}
+	}
+}
+
+// spread an interval randomly so users linked at the same time don't stay in lockstep
+func jitter(interval time.Duration) time.Duration {
+	spread := int64(float64(interval) * jitterFraction)
+	if spread <= 0 {
+		return interval
+	}
+	return interval + time.Duration(rand.Int63n(2*spread)-spread)
+}
+
+// SyncIntervalGet returns how often the user should be synced, the configured default if they haven't picked
+func SyncIntervalGet(ctx context.Context, s *state.State, userID string) (time.Duration, error) {
+
+	value, err := db.UserSettingGet(ctx, s.DB, userID, syncIntervalSetting)
+	if err == db.ErrNotFound {
+		return s.Config.DefaultSyncInterval, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Ignoring bad sync interval %q for user %s: %s", value, userID, err)
+		return s.Config.DefaultSyncInterval, nil
+	}
+
+	return interval, nil
+}
+
+// ErrUnsupportedSyncInterval is returned when saving an interval that isn't one of SyncIntervals
+var ErrUnsupportedSyncInterval = errors.New("unsupported sync interval")
+
+// ValidSyncInterval reports whether interval is one of SyncIntervals
+func ValidSyncInterval(interval time.Duration) bool {
+	for _, allowed := range SyncIntervals {
+		if interval == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// SyncIntervalSave saves how often the user should be synced, which must be one of SyncIntervals
+func SyncIntervalSave(ctx context.Context, s *state.State, userID string, interval time.Duration) error {
+
+	if !ValidSyncInterval(interval) {
+		return fmt.Errorf("%w: %s", ErrUnsupportedSyncInterval, interval)
+	}
+
+	return db.UserSettingSave(ctx, s.DB, userID, syncIntervalSetting, interval.String())
+}
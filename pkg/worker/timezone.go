@@ -0,0 +1,43 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/bdelliott/wfsync/pkg/db"
+	"github.com/bdelliott/wfsync/pkg/fatsecret"
+	"github.com/bdelliott/wfsync/pkg/state"
+)
+
+// the user's time zone as Withings reports it, e.g. "America/New_York"
+const timeZoneSetting = "withingsTimeZone"
+
+// save the user's time zone, which decides the day each weigh-in falls on
+func timeZoneSave(ctx context.Context, s *state.State, userID string, timeZone string) error {
+	return db.UserSettingSave(ctx, s.DB, userID, timeZoneSetting, timeZone)
+}
+
+// the user's time zone, UTC until Withings has told us
+func userLocation(ctx context.Context, s *state.State, userID string) (*time.Location, error) {
+
+	timeZone, err := db.UserSettingGet(ctx, s.DB, userID, timeZoneSetting)
+	if err == db.ErrNotFound {
+		return time.UTC, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	location, err := time.LoadLocation(timeZone)
+	if err != nil {
+		log.Printf("Ignoring unknown time zone %q for user %s: %s", timeZone, userID, err)
+		return time.UTC, nil
+	}
+	return location, nil
+}
+
+// the day a weigh-in at the unix time falls on, in the user's time zone
+func dayOf(timestamp int64, location *time.Location) fatsecret.Date {
+	return fatsecret.DateOf(time.Unix(timestamp, 0).In(location))
+}
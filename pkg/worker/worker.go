@@ -1,34 +1,83 @@
 package worker
 
 import (
-	"time"
+	"context"
+	"log"
 
 	"github.com/bdelliott/wfsync/pkg/db"
+	"github.com/bdelliott/wfsync/pkg/fatsecret"
 	"github.com/bdelliott/wfsync/pkg/state"
 	"github.com/bdelliott/wfsync/pkg/withings"
 )
 
 // SyncUser pulls measurements for the user and syncs to FatSecret.
-func SyncUser(s *state.State, withingsToken *db.WithingsToken) {
+func SyncUser(ctx context.Context, s *state.State, withingsToken *db.WithingsToken) error {
 
-	weights, err := withings.GetMeasurements(s.Withings, withingsToken)
+	userID := withingsToken.UserID
+
+	// pick up where the last sync left off, or fetch the full history if there wasn't one
+	cursor, err := db.WithingsCursorGet(ctx, s.DB, userID)
+	if err != nil && err != db.ErrNotFound {
+		return err
+	}
+
+	measurements, timeZone, next, err := withings.GetMeasurements(ctx, s.Withings, s.DB, userID, cursor)
+	if err != nil {
+		return err
+	}
+
+	if timeZone != "" {
+		err = timeZoneSave(ctx, s, userID, timeZone)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = db.MeasurementsSync(ctx, s.DB, userID, measurements)
+	if err != nil {
+		return err
+	}
+
+	err = db.WithingsCursorSave(ctx, s.DB, userID, next)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	db.WeightsSync(s.DB, withingsToken.UserID, weights)
+	return syncFatSecret(ctx, s, userID)
 }
 
-// SyncWorker handles bulk pulling from the Nokia API and syncing to the FatSecret API.
-func SyncWorker(s *state.State) {
-	// TODO run this infrequently to pull user measurements in bulk
-	// TODO we actually want async callbacks for daily measurements as the gold solution
+// Bring the local copy of the user's FatSecret weight history up to date, then push the weights it's
+// missing.
+func syncFatSecret(ctx context.Context, s *state.State, userID string) error {
 
-	// for each withings token, invoke synchronization of measurements for a single user:
-	withingsTokens := db.WithingsTokensGetAll(s.DB)
-	for _, withingsToken := range *withingsTokens {
-		SyncUser(s, &withingsToken)
+	user := db.User{UserID: userID}
+	token, secret, err := db.FatSecretTokenGet(ctx, s.DB, s.TokenKeys, user)
+	if err == db.ErrNotFound {
+		log.Printf("User %s has not linked FatSecret, skipping push", userID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	client := fatsecret.NewUserClient(s.FatSecret, token, secret)
+
+	err = pullFatSecretWeights(ctx, s, userID, client)
+	if err != nil {
+		return err
+	}
+
+	return pushWeights(ctx, s, userID, client)
+}
+
+// Push the user's weights to FatSecret, picking one weight a day by their reconciliation policy
+func pushWeights(ctx context.Context, s *state.State, userID string, client fatsecret.Client) error {
+
+	// weight.update switches the user's profile to the unit it's sent, so send the one it already has
+	profile, err := client.ProfileGet(ctx)
+	if err != nil {
+		return err
 	}
 
-	time.Sleep(time.Second * 30)
+	return reconcileWeights(ctx, s, userID, client, profile.WeightType())
 }